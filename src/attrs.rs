@@ -0,0 +1,252 @@
+//! Mount attribute flags passed to fsmount.
+
+use rustix::mount::MountAttrFlags;
+use serde::Serializer;
+
+/// Attributes that map to a single MOUNT_ATTR bit.
+const ATTR_FLAGS: &[(&str, MountAttrFlags)] = &[
+    ("ro", MountAttrFlags::MOUNT_ATTR_RDONLY),
+    ("nosuid", MountAttrFlags::MOUNT_ATTR_NOSUID),
+    ("nodev", MountAttrFlags::MOUNT_ATTR_NODEV),
+    ("noexec", MountAttrFlags::MOUNT_ATTR_NOEXEC),
+    ("nodiratime", MountAttrFlags::MOUNT_ATTR_NODIRATIME),
+    ("nosymfollow", MountAttrFlags::MOUNT_ATTR_NOSYMFOLLOW),
+];
+
+/// Values of the MOUNT_ATTR__ATIME field, of which at most one may be set.
+/// MOUNT_ATTR_RELATIME is zero, so the choice is tracked by name rather than
+/// by inspecting the mask.
+const ATIME_FLAGS: &[(&str, MountAttrFlags)] = &[
+    ("relatime", MountAttrFlags::MOUNT_ATTR_RELATIME),
+    ("noatime", MountAttrFlags::MOUNT_ATTR_NOATIME),
+    ("strictatime", MountAttrFlags::MOUNT_ATTR_STRICTATIME),
+];
+
+/// An --attrs list as parsed: the combined mask, and the atime value it
+/// named, which the mask cannot show when it is the zero relatime.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub struct AttrList {
+    pub flags: MountAttrFlags,
+    pub atime: Option<&'static str>,
+}
+
+impl Default for AttrList {
+    fn default() -> AttrList {
+        AttrList {
+            flags: MountAttrFlags::empty(),
+            atime: None,
+        }
+    }
+}
+
+/// Parses a comma-separated attribute list like "ro,nosuid,relatime" into
+/// the combined attr_flags mask.
+pub fn parse_attrs(list: &str) -> Result<MountAttrFlags, String> {
+    parse_attr_list(list).map(|attrs| attrs.flags)
+}
+
+/// Parses an attribute list like [`parse_attrs`], keeping the name of the
+/// atime value it contains.
+pub fn parse_attr_list(list: &str) -> Result<AttrList, String> {
+    let mut attrs = AttrList::default();
+    for name in list.split(',').filter(|name| !name.is_empty()) {
+        if let Some((_, flag)) = ATTR_FLAGS.iter().find(|(n, _)| *n == name) {
+            attrs.flags |= *flag;
+        } else if let Some((atime, flag)) = ATIME_FLAGS.iter().find(|(n, _)| *n == name) {
+            match attrs.atime {
+                Some(prev) if prev != name => {
+                    return Err(format!(
+                        "conflicting atime attributes {} and {}",
+                        prev, name
+                    ));
+                }
+                _ => attrs.atime = Some(atime),
+            }
+            attrs.flags |= *flag;
+        } else {
+            return Err(format!("unknown mount attribute {:?}", name));
+        }
+    }
+    check_atime(attrs.flags)?;
+    Ok(attrs)
+}
+
+/// Adds the atime behavior name (one of ATIME_FLAGS or nodiratime) to the
+/// flags of attrs. An atime value named in attrs must be the same one.
+pub fn with_atime(attrs: AttrList, name: &str) -> Result<MountAttrFlags, String> {
+    let flag = match ATIME_FLAGS.iter().find(|(n, _)| *n == name) {
+        Some((_, flag)) => {
+            if let Some(prev) = attrs.atime.filter(|prev| *prev != name) {
+                return Err(format!(
+                    "--atime {} conflicts with {} in --attrs",
+                    name, prev
+                ));
+            }
+            *flag
+        }
+        None if name == "nodiratime" => MountAttrFlags::MOUNT_ATTR_NODIRATIME,
+        None => return Err(format!("unknown atime behavior {:?}", name)),
+    };
+    let flags = attrs.flags | flag;
+    check_atime(flags)?;
+    Ok(flags)
+}
+
+/// Rejects nodiratime together with strictatime, which asks for every
+/// access time to be updated, directories included.
+fn check_atime(flags: MountAttrFlags) -> Result<(), String> {
+    if flags.contains(MountAttrFlags::MOUNT_ATTR_NODIRATIME)
+        && flags & MountAttrFlags::MOUNT_ATTR__ATIME == MountAttrFlags::MOUNT_ATTR_STRICTATIME
+    {
+        return Err("conflicting atime attributes strictatime and nodiratime".to_string());
+    }
+    Ok(())
+}
+
+/// Splits flags into its named attributes, in the same order parse_attrs
+/// accepts them. The default relatime is left implicit.
+pub fn named_attrs(flags: MountAttrFlags) -> Vec<(&'static str, MountAttrFlags)> {
+    let mut named: Vec<(&'static str, MountAttrFlags)> = ATTR_FLAGS
+        .iter()
+        .filter(|(_, flag)| flags.contains(*flag))
+        .copied()
+        .collect();
+    let atime = flags & MountAttrFlags::MOUNT_ATTR__ATIME;
+    if let Some(entry) = ATIME_FLAGS
+        .iter()
+        .find(|(_, flag)| !flag.is_empty() && *flag == atime)
+    {
+        named.push(*entry);
+    }
+    named
+}
+
+/// Returns the symbolic names of the attributes set in flags.
+pub fn attr_names(flags: MountAttrFlags) -> Vec<&'static str> {
+    named_attrs(flags)
+        .into_iter()
+        .map(|(name, _)| name)
+        .collect()
+}
+
+/// Returns every attribute name parse_attrs accepts.
+pub fn known_names() -> Vec<&'static str> {
+    ATTR_FLAGS
+        .iter()
+        .chain(ATIME_FLAGS)
+        .map(|(name, _)| *name)
+        .collect()
+}
+
+/// Serializes attr flags as a list of their symbolic names.
+pub fn serialize_attrs<S: Serializer>(flags: &MountAttrFlags, s: S) -> Result<S::Ok, S::Error> {
+    s.collect_seq(attr_names(*flags))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parse_attrs_combines() {
+        let flags = parse_attrs("ro,nosuid,nodev,noexec,relatime").unwrap();
+        assert_eq!(
+            flags,
+            MountAttrFlags::MOUNT_ATTR_RDONLY
+                | MountAttrFlags::MOUNT_ATTR_NOSUID
+                | MountAttrFlags::MOUNT_ATTR_NODEV
+                | MountAttrFlags::MOUNT_ATTR_NOEXEC
+        );
+        assert_eq!(parse_attrs("").unwrap(), MountAttrFlags::empty());
+        assert_eq!(
+            parse_attrs("nosuid,,nodev").unwrap(),
+            MountAttrFlags::MOUNT_ATTR_NOSUID | MountAttrFlags::MOUNT_ATTR_NODEV
+        );
+    }
+
+    #[test]
+    fn parse_attrs_atime() {
+        let flags = parse_attrs("ro,noatime").unwrap();
+        assert_eq!(
+            flags & MountAttrFlags::MOUNT_ATTR__ATIME,
+            MountAttrFlags::MOUNT_ATTR_NOATIME
+        );
+        assert!(flags.contains(MountAttrFlags::MOUNT_ATTR_RDONLY));
+        assert_eq!(attr_names(flags), ["ro", "noatime"]);
+        // Repeating the same value is fine
+        assert_eq!(
+            parse_attrs("strictatime,strictatime").unwrap(),
+            MountAttrFlags::MOUNT_ATTR_STRICTATIME
+        );
+    }
+
+    #[test]
+    fn parse_attrs_conflicts() {
+        assert_eq!(
+            parse_attrs("noatime,strictatime").unwrap_err(),
+            "conflicting atime attributes noatime and strictatime"
+        );
+        // relatime is zero but still conflicts by name
+        assert_eq!(
+            parse_attrs("relatime,noatime").unwrap_err(),
+            "conflicting atime attributes relatime and noatime"
+        );
+        assert_eq!(
+            parse_attrs("strictatime,nodiratime").unwrap_err(),
+            "conflicting atime attributes strictatime and nodiratime"
+        );
+        assert_eq!(
+            parse_attrs("ro,bogus").unwrap_err(),
+            "unknown mount attribute \"bogus\""
+        );
+    }
+
+    fn with_atime_after(list: &str, name: &str) -> Result<MountAttrFlags, String> {
+        with_atime(parse_attr_list(list).unwrap(), name)
+    }
+
+    #[test]
+    fn attr_list_keeps_the_atime_name() {
+        let attrs = parse_attr_list("ro,relatime").unwrap();
+        assert_eq!(attrs.flags, MountAttrFlags::MOUNT_ATTR_RDONLY);
+        assert_eq!(attrs.atime, Some("relatime"));
+        assert_eq!(parse_attr_list("nosuid").unwrap().atime, None);
+    }
+
+    #[test]
+    fn with_atime_adds_to_attrs() {
+        assert_eq!(
+            with_atime_after("ro", "noatime").unwrap(),
+            MountAttrFlags::MOUNT_ATTR_RDONLY | MountAttrFlags::MOUNT_ATTR_NOATIME
+        );
+        assert_eq!(
+            with_atime_after("noatime", "noatime").unwrap(),
+            MountAttrFlags::MOUNT_ATTR_NOATIME
+        );
+        assert_eq!(
+            with_atime_after("relatime", "nodiratime").unwrap(),
+            MountAttrFlags::MOUNT_ATTR_NODIRATIME
+        );
+        assert_eq!(
+            with_atime_after("", "bogus").unwrap_err(),
+            "unknown atime behavior \"bogus\""
+        );
+    }
+
+    #[test]
+    fn with_atime_conflicts_both_ways() {
+        assert_eq!(
+            with_atime_after("noatime", "relatime").unwrap_err(),
+            "--atime relatime conflicts with noatime in --attrs"
+        );
+        // relatime sets no bit, but was named in --attrs all the same
+        assert_eq!(
+            with_atime_after("relatime", "noatime").unwrap_err(),
+            "--atime noatime conflicts with relatime in --attrs"
+        );
+        assert_eq!(
+            with_atime_after("strictatime", "nodiratime").unwrap_err(),
+            "conflicting atime attributes strictatime and nodiratime"
+        );
+    }
+}
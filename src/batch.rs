@@ -0,0 +1,417 @@
+//! Parsing the --config file that lists several mounts.
+//!
+//! Each non-empty line holds the mic arguments for one mount, e.g.
+//!
+//! ```text
+//! # scratch space
+//! --target /mnt/scratch --fstype tmpfs -o size=64M
+//! --target "/mnt/with space" --source /srv/data
+//! ```
+//!
+//! Arguments are separated by whitespace. Single quotes keep everything up
+//! to the next single quote literally; inside double quotes and outside any
+//! quotes a backslash escapes the next character. Lines starting with `#`
+//! are comments.
+
+use serde::Serialize;
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use crate::mountinfo::MountInfo;
+
+/// The arguments for one mount and the line they were read from.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct Entry {
+    /// 1-based line number, for error messages.
+    pub line: usize,
+    pub args: Vec<String>,
+}
+
+/// Parses the contents of a --config file into its entries, in order.
+pub fn parse(text: &str) -> Result<Vec<Entry>, String> {
+    let mut entries = Vec::new();
+    for (i, line) in text.lines().enumerate() {
+        let trimmed = line.trim_start();
+        if trimmed.is_empty() || trimmed.starts_with('#') {
+            continue;
+        }
+        let args = split_line(trimmed).map_err(|e| format!("line {}: {}", i + 1, e))?;
+        entries.push(Entry { line: i + 1, args });
+    }
+    Ok(entries)
+}
+
+/// Splits one line into arguments as described in the module docs.
+fn split_line(line: &str) -> Result<Vec<String>, String> {
+    let mut args = Vec::new();
+    let mut current: Option<String> = None;
+    let mut chars = line.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            c if c.is_whitespace() => {
+                if let Some(arg) = current.take() {
+                    args.push(arg);
+                }
+            }
+            '\'' => {
+                let arg = current.get_or_insert_with(String::new);
+                loop {
+                    match chars.next() {
+                        Some('\'') => break,
+                        Some(c) => arg.push(c),
+                        None => return Err("unterminated single quote".to_string()),
+                    }
+                }
+            }
+            '"' => {
+                let arg = current.get_or_insert_with(String::new);
+                loop {
+                    match chars.next() {
+                        Some('"') => break,
+                        Some('\\') => match chars.next() {
+                            Some(c) => arg.push(c),
+                            None => return Err("unterminated double quote".to_string()),
+                        },
+                        Some(c) => arg.push(c),
+                        None => return Err("unterminated double quote".to_string()),
+                    }
+                }
+            }
+            '\\' => match chars.next() {
+                Some(c) => current.get_or_insert_with(String::new).push(c),
+                None => return Err("backslash at end of line".to_string()),
+            },
+            c => current.get_or_insert_with(String::new).push(c),
+        }
+    }
+    if let Some(arg) = current {
+        args.push(arg);
+    }
+    Ok(args)
+}
+
+/// Mounts the items of a --config run in order with mount, which returns
+/// how long the mount took, and returns those durations. The first failure
+/// stops the run; with rollback, undo is then called on the items mounted
+/// before it, newest first. Items for which mounts is false, such as --stat
+/// or --unmount entries, leave nothing behind and are never undone.
+pub fn mount_all<T>(
+    items: &[T],
+    rollback: bool,
+    mounts: impl Fn(&T) -> bool,
+    mut mount: impl FnMut(&T) -> Result<Duration, String>,
+    mut undo: impl FnMut(&T),
+) -> Result<Vec<Duration>, String> {
+    let mut durations = Vec::new();
+    let mut mounted = Vec::new();
+    for item in items {
+        match mount(item) {
+            Ok(took) => {
+                durations.push(took);
+                if mounts(item) {
+                    mounted.push(item);
+                }
+            }
+            Err(e) => {
+                if rollback {
+                    mounted.into_iter().rev().for_each(&mut undo);
+                }
+                return Err(e);
+            }
+        }
+    }
+    Ok(durations)
+}
+
+/// Aggregate durations of the mounts of a --config run, in milliseconds.
+#[derive(Clone, Debug, PartialEq, Serialize)]
+pub struct Latency {
+    pub min_ms: f64,
+    pub max_ms: f64,
+    pub p50_ms: f64,
+    pub p95_ms: f64,
+}
+
+/// Returns the minimum, maximum, median and 95th percentile of durations,
+/// or None if there are none.
+pub fn latency(durations: &[Duration]) -> Option<Latency> {
+    let mut sorted = durations.to_vec();
+    sorted.sort();
+    // Whole microseconds, so the JSON shows e.g. 3.222 rather than
+    // 3.2226429999999997
+    let ms = |d: Duration| d.as_micros() as f64 / 1000.0;
+    Some(Latency {
+        min_ms: ms(*sorted.first()?),
+        max_ms: ms(*sorted.last()?),
+        p50_ms: ms(percentile(&sorted, 50)),
+        p95_ms: ms(percentile(&sorted, 95)),
+    })
+}
+
+/// Returns the p-th percentile of the non-empty sorted by the nearest-rank
+/// method: the smallest value that at least p percent of them do not
+/// exceed. It is always one of the values, never an interpolation.
+fn percentile(sorted: &[Duration], p: usize) -> Duration {
+    let rank = (p * sorted.len()).div_ceil(100).max(1);
+    sorted[rank - 1]
+}
+
+/// Reads of procfs files that the entries of a --config run would each
+/// repeat, made once per file for the whole run with read. mountinfo
+/// changes with every mount and is read again after invalidate_mountinfo.
+/// The filesystems the kernel supports only change when a module is loaded,
+/// which the cache does not notice.
+pub struct ProcCache<R> {
+    read: R,
+    filesystems: HashMap<PathBuf, Vec<String>>,
+    mountinfo: HashMap<PathBuf, Vec<MountInfo>>,
+}
+
+impl<R: FnMut(&Path) -> Result<String, String>> ProcCache<R> {
+    pub fn new(read: R) -> ProcCache<R> {
+        ProcCache {
+            read,
+            filesystems: HashMap::new(),
+            mountinfo: HashMap::new(),
+        }
+    }
+
+    /// Returns the filesystem types listed in the `filesystems` file at
+    /// path, e.g. `/proc/filesystems`.
+    pub fn filesystems(&mut self, path: &Path) -> Result<&[String], String> {
+        if !self.filesystems.contains_key(path) {
+            // Lines are "nodev\ttmpfs" or "\text4"
+            let names = (self.read)(path)?
+                .lines()
+                .filter_map(|line| line.split_whitespace().last())
+                .map(str::to_string)
+                .collect();
+            self.filesystems.insert(path.to_path_buf(), names);
+        }
+        Ok(&self.filesystems[path])
+    }
+
+    /// Returns the mounts in the mountinfo file at path.
+    pub fn mountinfo(&mut self, path: &Path) -> Result<&[MountInfo], String> {
+        if !self.mountinfo.contains_key(path) {
+            let mounts = (self.read)(path)?
+                .lines()
+                .map(MountInfo::parse)
+                .collect::<Result<_, _>>()?;
+            self.mountinfo.insert(path.to_path_buf(), mounts);
+        }
+        Ok(&self.mountinfo[path])
+    }
+
+    /// Forgets every mountinfo read, after something was mounted.
+    pub fn invalidate_mountinfo(&mut self) {
+        self.mountinfo.clear();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn ms(n: u64) -> Duration {
+        Duration::from_millis(n)
+    }
+
+    #[test]
+    fn percentiles_of_known_sample() {
+        // 1..=20ms, shuffled
+        let sample: Vec<Duration> = [
+            7, 3, 20, 1, 14, 9, 18, 2, 11, 5, 16, 4, 13, 19, 6, 10, 8, 15, 12, 17,
+        ]
+        .map(ms)
+        .to_vec();
+        let l = latency(&sample).unwrap();
+        assert_eq!(l.min_ms, 1.0);
+        assert_eq!(l.max_ms, 20.0);
+        // Nearest rank: ceil(0.5 * 20) = 10th, ceil(0.95 * 20) = 19th
+        assert_eq!(l.p50_ms, 10.0);
+        assert_eq!(l.p95_ms, 19.0);
+    }
+
+    #[test]
+    fn percentiles_of_small_samples() {
+        let l = latency(&[ms(5)]).unwrap();
+        assert_eq!(
+            (l.min_ms, l.p50_ms, l.p95_ms, l.max_ms),
+            (5.0, 5.0, 5.0, 5.0)
+        );
+        let l = latency(&[ms(30), ms(10), ms(20)]).unwrap();
+        assert_eq!((l.p50_ms, l.p95_ms), (20.0, 30.0));
+        assert_eq!(latency(&[]), None);
+        let sorted: Vec<Duration> = (1..=100).map(ms).collect();
+        assert_eq!(percentile(&sorted, 95), ms(95));
+        assert_eq!(percentile(&sorted, 0), ms(1));
+        assert_eq!(percentile(&sorted, 100), ms(100));
+    }
+
+    const FILESYSTEMS: &str = "nodev\tsysfs\nnodev\ttmpfs\n\text4\n";
+    const MOUNTINFO: &str = "22 1 0:21 / / rw - ext4 /dev/sda1 rw\n";
+
+    /// A reader serving the two files above and counting reads per path.
+    fn reader(
+        reads: &mut HashMap<PathBuf, usize>,
+    ) -> impl FnMut(&Path) -> Result<String, String> + '_ {
+        move |path| {
+            *reads.entry(path.to_path_buf()).or_default() += 1;
+            match path.file_name().and_then(|name| name.to_str()) {
+                Some("filesystems") => Ok(FILESYSTEMS.to_string()),
+                Some("mountinfo") => Ok(MOUNTINFO.to_string()),
+                _ => Err(format!("read {} failed", path.display())),
+            }
+        }
+    }
+
+    #[test]
+    fn filesystems_are_read_once() {
+        let mut reads = HashMap::new();
+        let mut cache = ProcCache::new(reader(&mut reads));
+        let path = Path::new("/proc/filesystems");
+        assert_eq!(cache.filesystems(path).unwrap(), ["sysfs", "tmpfs", "ext4"]);
+        assert!(cache
+            .filesystems(path)
+            .unwrap()
+            .contains(&"tmpfs".to_string()));
+        // A mount does not change them
+        cache.invalidate_mountinfo();
+        assert_eq!(cache.filesystems(path).unwrap().len(), 3);
+        drop(cache);
+        assert_eq!(reads[path], 1);
+    }
+
+    #[test]
+    fn mountinfo_is_read_again_after_invalidation() {
+        let mut reads = HashMap::new();
+        let mut cache = ProcCache::new(reader(&mut reads));
+        let path = Path::new("/proc/self/mountinfo");
+        let other = Path::new("/host/proc/self/mountinfo");
+        assert_eq!(cache.mountinfo(path).unwrap()[0].mount_point, "/");
+        cache.mountinfo(path).unwrap();
+        cache.mountinfo(other).unwrap();
+        cache.invalidate_mountinfo();
+        cache.mountinfo(path).unwrap();
+        assert!(cache.mountinfo(Path::new("/nosuch")).is_err());
+        drop(cache);
+        assert_eq!(reads[path], 2);
+        assert_eq!(reads[other], 1);
+    }
+
+    /// Runs mount_all over items, failing the one named fail, and returns
+    /// the result and every mount and undo call in order.
+    fn run_all(
+        items: &[&'static str],
+        fail: &str,
+        rollback: bool,
+    ) -> (Result<Vec<Duration>, String>, Vec<String>) {
+        let calls = std::cell::RefCell::new(Vec::new());
+        // Items starting with - stand for entries that mount nothing
+        let result = mount_all(
+            items,
+            rollback,
+            |item| !item.starts_with('-'),
+            |item| {
+                calls.borrow_mut().push(format!("mount {}", item));
+                if *item == fail {
+                    return Err(format!("{} failed", item));
+                }
+                Ok(ms(item.len() as u64))
+            },
+            |item| calls.borrow_mut().push(format!("undo {}", item)),
+        );
+        (result, calls.into_inner())
+    }
+
+    #[test]
+    fn mount_all_mounts_in_order() {
+        let (result, calls) = run_all(&["a", "bb", "ccc"], "", true);
+        assert_eq!(result.unwrap(), [ms(1), ms(2), ms(3)]);
+        assert_eq!(calls, ["mount a", "mount bb", "mount ccc"]);
+    }
+
+    #[test]
+    fn mount_all_rolls_back_newest_first() {
+        let (result, calls) = run_all(&["a", "bb", "ccc", "dddd"], "ccc", true);
+        assert_eq!(result.unwrap_err(), "ccc failed");
+        assert_eq!(
+            calls,
+            ["mount a", "mount bb", "mount ccc", "undo bb", "undo a"]
+        );
+    }
+
+    #[test]
+    fn mount_all_stops_without_rollback() {
+        let (result, calls) = run_all(&["a", "bb", "ccc"], "bb", false);
+        assert_eq!(result.unwrap_err(), "bb failed");
+        assert_eq!(calls, ["mount a", "mount bb"]);
+        // Nothing to roll back when the first one fails
+        let (_, calls) = run_all(&["a", "bb"], "a", true);
+        assert_eq!(calls, ["mount a"]);
+    }
+
+    #[test]
+    fn mount_all_rolls_back_only_what_it_mounted() {
+        let (result, calls) = run_all(&["a", "-stat", "ccc", "dddd"], "ccc", true);
+        assert_eq!(result.unwrap_err(), "ccc failed");
+        assert_eq!(calls, ["mount a", "mount -stat", "mount ccc", "undo a"]);
+    }
+
+    fn args(line: &str) -> Vec<String> {
+        split_line(line).unwrap()
+    }
+
+    #[test]
+    fn parse_skips_comments_and_blank_lines() {
+        let text =
+            "# scratch\n\n--target /mnt/a --fstype tmpfs\n   # indented\n  --target /mnt/b\n";
+        let entries = parse(text).unwrap();
+        assert_eq!(
+            entries,
+            [
+                Entry {
+                    line: 3,
+                    args: args("--target /mnt/a --fstype tmpfs"),
+                },
+                Entry {
+                    line: 5,
+                    args: args("--target /mnt/b"),
+                },
+            ]
+        );
+        assert!(parse("# nothing\n").unwrap().is_empty());
+    }
+
+    #[test]
+    fn split_line_quoting() {
+        assert_eq!(
+            args("-o  size=1M\t--target x"),
+            ["-o", "size=1M", "--target", "x"]
+        );
+        assert_eq!(
+            args(r#"--target "/mnt/with space" -o 'a="b" \c'"#),
+            ["--target", "/mnt/with space", "-o", r#"a="b" \c"#]
+        );
+        assert_eq!(args(r#"a\ b "c\"d" e'f'g"#), ["a b", "c\"d", "efg"]);
+        assert_eq!(args(r#"'' """#), ["", ""]);
+    }
+
+    #[test]
+    fn parse_reports_the_line() {
+        assert_eq!(
+            parse("--target a\n--target 'b\n").unwrap_err(),
+            "line 2: unterminated single quote"
+        );
+        assert_eq!(
+            parse("-o \"x").unwrap_err(),
+            "line 1: unterminated double quote"
+        );
+        assert_eq!(
+            parse("--target a\\").unwrap_err(),
+            "line 1: backslash at end of line"
+        );
+    }
+}
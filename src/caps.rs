@@ -0,0 +1,75 @@
+//! Decoding the capability sets in /proc/<pid>/status.
+
+use std::path::Path;
+
+/// Capability names indexed by bit number, as in linux/capability.h.
+const CAP_NAMES: &[&str] = &[
+    "cap_chown",
+    "cap_dac_override",
+    "cap_dac_read_search",
+    "cap_fowner",
+    "cap_fsetid",
+    "cap_kill",
+    "cap_setgid",
+    "cap_setuid",
+    "cap_setpcap",
+    "cap_linux_immutable",
+    "cap_net_bind_service",
+    "cap_net_broadcast",
+    "cap_net_admin",
+    "cap_net_raw",
+    "cap_ipc_lock",
+    "cap_ipc_owner",
+    "cap_sys_module",
+    "cap_sys_rawio",
+    "cap_sys_chroot",
+    "cap_sys_ptrace",
+    "cap_sys_pacct",
+    "cap_sys_admin",
+    "cap_sys_boot",
+    "cap_sys_nice",
+    "cap_sys_resource",
+    "cap_sys_time",
+    "cap_sys_tty_config",
+    "cap_mknod",
+    "cap_lease",
+    "cap_audit_write",
+    "cap_audit_control",
+    "cap_setfcap",
+    "cap_mac_override",
+    "cap_mac_admin",
+    "cap_syslog",
+    "cap_wake_alarm",
+    "cap_block_suspend",
+    "cap_audit_read",
+    "cap_perfmon",
+    "cap_bpf",
+    "cap_checkpoint_restore",
+];
+
+/// Bit number of CAP_SYS_ADMIN, which creating and attaching mounts needs.
+pub const CAP_SYS_ADMIN: u32 = 21;
+
+/// Reads the effective capability mask (CapEff) from a status file such as
+/// /proc/self/status.
+pub fn effective(status: &Path) -> Result<u64, String> {
+    let text = std::fs::read_to_string(status)
+        .map_err(|e| format!("read {} failed: {}", status.display(), e))?;
+    let hex = text
+        .lines()
+        .find_map(|line| line.strip_prefix("CapEff:"))
+        .ok_or_else(|| format!("no CapEff line in {}", status.display()))?;
+    u64::from_str_radix(hex.trim(), 16).map_err(|e| format!("invalid CapEff {:?}: {}", hex, e))
+}
+
+/// Returns the names of the capabilities set in mask, in bit order. Bits
+/// newer than this table are named cap_<bit>.
+pub fn names(mask: u64) -> Vec<String> {
+    (0..64)
+        .filter(|bit| mask & (1 << bit) != 0)
+        .map(|bit| match CAP_NAMES.get(bit) {
+            Some(name) => name.to_string(),
+            None => format!("cap_{}", bit),
+        })
+        .collect()
+}
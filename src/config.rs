@@ -0,0 +1,221 @@
+//! The resolved description of a mount, independent of how it was specified.
+
+use clap::ValueEnum;
+use rustix::mount::{MountAttrFlags, MountPropagationFlags};
+use serde::{Serialize, Serializer};
+use sha2::{Digest, Sha256};
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use crate::attrs;
+use crate::options::{FsOption, ValueKind};
+
+/// Everything needed to perform one mount.
+#[derive(Clone, Debug, Serialize)]
+pub struct Config {
+    /// Mountpoint the new mount is attached at.
+    pub target: String,
+    /// Directory to bind, or the `source` parameter when fstype is set.
+    pub source: String,
+    /// Filesystem type to create with fsopen; None bind mounts source.
+    pub fstype: Option<String>,
+    /// fsconfig options, applied in order after source.
+    pub options: Vec<FsOption>,
+    /// Upper bound on the number of options, checked before any syscall.
+    pub max_options: Option<usize>,
+    /// Upper bound on the bytes of an option key or string value, its NUL
+    /// included, checked before any syscall.
+    pub max_option_len: usize,
+    /// Apply all options, collecting the rejected ones, instead of stopping
+    /// at the first failure.
+    pub continue_on_option_error: bool,
+    /// Go on to mount even if some options were rejected.
+    pub ignore_option_errors: bool,
+    /// Set source after options rather than before them.
+    pub source_last: bool,
+    /// Pass source as an O_RDWR fd with FSCONFIG_SET_FD.
+    pub source_fd: bool,
+    /// attr_flags passed to fsmount.
+    #[serde(serialize_with = "attrs::serialize_attrs")]
+    pub attrs: MountAttrFlags,
+    /// Drop a single attribute the filesystem rejects instead of failing.
+    pub relax_attrs: bool,
+    /// User namespace whose id mapping the mount is idmapped with.
+    pub userns: Option<String>,
+    /// Check the target's statfs magic against fstype after mounting.
+    pub verify_magic: bool,
+    /// Stack on a mount already exactly at target, with a warning.
+    pub warn_overmount: bool,
+    /// Unmount what is mounted at target before attaching.
+    pub force_create: bool,
+    /// Turn warnings such as an existing mount at target into errors.
+    pub strict: bool,
+    /// Make the mount the target resides on private before attaching.
+    pub private_parent: bool,
+    /// After attaching, wait up to this long for statfs on target to succeed.
+    #[serde(serialize_with = "serialize_duration")]
+    pub wait_ready: Option<Duration>,
+    /// Unmount again if the mount is not ready within wait_ready.
+    pub teardown_on_not_ready: bool,
+    /// Bind the mounts below source along with it.
+    pub recursive: bool,
+    /// Bind a file source onto a file target.
+    pub allow_file_target: bool,
+    /// Source names a mountpoint whose mount is cloned as a whole.
+    pub clone_from: bool,
+    /// How often to retry creating the target after ENOENT or EEXIST.
+    pub mkdir_retries: u32,
+    /// Clear the umask while creating target directories.
+    pub mkdir_umask: bool,
+    /// Also create a missing target in the caller's namespace.
+    pub mkdir: bool,
+    /// Permission bits for the target and directories created for it.
+    pub mode: u32,
+    /// Only mount if the target directory is owned by this uid.
+    pub require_owner: Option<u32>,
+    /// Run extra sanity checks before mounting.
+    pub validate: bool,
+    /// Where procfs is mounted.
+    pub proc_path: String,
+    /// Mount namespace to attach in; empty attaches in the current one.
+    pub mount_namespace: String,
+    /// User namespace to join before creating the mount.
+    pub user_namespace: Option<String>,
+    /// Network namespace to join before creating the mount.
+    pub net_namespace: Option<String>,
+    /// Attach in a freshly unshared mount namespace.
+    pub new_namespace: bool,
+    /// Make the unshared namespace's root recursively private.
+    pub isolate: bool,
+    /// Further paths the mount is bound at after attaching it at target.
+    pub also_at: Vec<String>,
+    /// Socket to send the configured fs context to instead of mounting.
+    pub send_context: Option<String>,
+    /// Socket to receive a configured fs context on and mount it.
+    pub recv_context: Option<String>,
+    /// Make the mount read-only once everything else is done.
+    pub then_ro: bool,
+    /// Mount fuse on a new /dev/fuse connection.
+    pub fuse: bool,
+    /// Socket to send the /dev/fuse fd to once the mount is attached.
+    pub fuse_socket: Option<String>,
+    /// Command run in the target namespace after mounting; the mount is
+    /// undone if it fails.
+    pub post_mount_exec: Vec<String>,
+    /// Propagation type set on the mount once it is attached.
+    pub propagation: Option<Propagation>,
+}
+
+/// Mount propagation types, as in mount(8) --make-*.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize, ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub enum Propagation {
+    /// Receive and send no mount events (MS_PRIVATE)
+    Private,
+    /// Share mount events with the peer group (MS_SHARED)
+    Shared,
+    /// Receive mount events from the master but send none (MS_SLAVE)
+    Slave,
+    /// Private, and refuse to be the source of a bind mount (MS_UNBINDABLE)
+    Unbindable,
+}
+
+impl Propagation {
+    pub fn flags(self) -> MountPropagationFlags {
+        match self {
+            Propagation::Private => MountPropagationFlags::PRIVATE,
+            Propagation::Shared => MountPropagationFlags::SHARED,
+            Propagation::Slave => MountPropagationFlags::SLAVE,
+            Propagation::Unbindable => MountPropagationFlags::UNBINDABLE,
+        }
+    }
+}
+
+impl Config {
+    /// Returns the path of entry under the calling thread's own directory
+    /// in procfs, e.g. `ns/mnt` for `/proc/thread-self/ns/mnt`. Under
+    /// --timeout the mount runs on a worker thread, and only that thread
+    /// enters the target namespace; `/proc/self` would show the main
+    /// thread's.
+    pub fn proc_thread_self(&self, entry: &str) -> PathBuf {
+        Path::new(&self.proc_path).join("thread-self").join(entry)
+    }
+
+    /// Returns a hex SHA-256 over what defines the mount, in a canonical
+    /// form, so that two requests for the same mount hash the same. Options
+    /// are sorted by key; ones sharing a key keep their order, as the later
+    /// can override or add to the earlier. A binary option is hashed by the
+    /// contents of its file rather than the file's name. Settings that only
+    /// change how mic goes about mounting, such as proc_path, mkdir_retries
+    /// or verify_magic, are left out.
+    pub fn hash(&self) -> Result<String, String> {
+        let mut options = self.options.clone();
+        options.sort_by(|a, b| a.key.cmp(&b.key));
+        for opt in &mut options {
+            if let (ValueKind::Binary, Some(file)) = (opt.kind, &opt.value) {
+                let data = std::fs::read(file).map_err(|e| {
+                    format!("reading {} for option {} failed: {}", file, opt.key, e)
+                })?;
+                opt.value = Some(hex(&Sha256::digest(&data)));
+            }
+        }
+        let spec = MountSpec {
+            target: &self.target,
+            source: &self.source,
+            fstype: &self.fstype,
+            options,
+            attrs: self.attrs,
+            userns: &self.userns,
+            recursive: self.recursive,
+            clone_from: self.clone_from,
+            mount_namespace: &self.mount_namespace,
+            user_namespace: &self.user_namespace,
+            net_namespace: &self.net_namespace,
+            new_namespace: self.new_namespace,
+            isolate: self.isolate,
+            also_at: &self.also_at,
+            then_ro: self.then_ro,
+            fuse: self.fuse,
+            propagation: self.propagation,
+        };
+        let json =
+            serde_json::to_vec(&spec).map_err(|e| format!("encoding config failed: {}", e))?;
+        Ok(hex(&Sha256::digest(&json)))
+    }
+}
+
+/// The part of a Config that defines the resulting mount, as hashed by
+/// Config::hash.
+#[derive(Serialize)]
+struct MountSpec<'a> {
+    target: &'a str,
+    source: &'a str,
+    fstype: &'a Option<String>,
+    options: Vec<FsOption>,
+    #[serde(serialize_with = "attrs::serialize_attrs")]
+    attrs: MountAttrFlags,
+    userns: &'a Option<String>,
+    recursive: bool,
+    clone_from: bool,
+    mount_namespace: &'a str,
+    user_namespace: &'a Option<String>,
+    net_namespace: &'a Option<String>,
+    new_namespace: bool,
+    isolate: bool,
+    also_at: &'a [String],
+    then_ro: bool,
+    fuse: bool,
+    propagation: Option<Propagation>,
+}
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+/// Serializes a duration in the same human-readable form the flags accept.
+fn serialize_duration<S: Serializer>(d: &Option<Duration>, s: S) -> Result<S::Ok, S::Error> {
+    match d {
+        Some(d) => s.collect_str(&humantime::format_duration(*d)),
+        None => s.serialize_none(),
+    }
+}
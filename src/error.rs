@@ -0,0 +1,252 @@
+//! Errors from [`crate::mount::mount`], by the step that failed.
+
+use rustix::io::Errno;
+use std::fmt;
+use std::path::PathBuf;
+
+/// A failed step of a mount and the errno it failed with.
+///
+/// Display gives the same one-line message the mic binary prints. Callers
+/// that need to react to a specific failure can match on the variant for
+/// the step and on [`MountError::errno`] for the cause, e.g. EPERM from
+/// fsopen as opposed to EINVAL from fsconfig.
+#[derive(Debug)]
+pub enum MountError {
+    /// fsopen of the filesystem type.
+    Fsopen { fstype: String, errno: Errno },
+    /// fsconfig setting the source or an option, with whatever the kernel
+    /// logged on the context about it.
+    Fsconfig {
+        option: String,
+        errno: Errno,
+        log: String,
+    },
+    /// FSCONFIG_CMD_CREATE.
+    Create {
+        fstype: String,
+        errno: Errno,
+        log: String,
+    },
+    /// fsmount of the created filesystem.
+    Fsmount { errno: Errno, log: String },
+    /// fsconfig rejecting some of the options, with continue_on_option_error;
+    /// errors holds an [`MountError::Fsconfig`] for each.
+    Rejected {
+        fstype: String,
+        errors: Vec<MountError>,
+    },
+    /// Opening the source device read-write for source_fd.
+    OpenDevice { source: String, errno: Errno },
+    /// open_tree cloning the bind source.
+    OpenTree { source: String, errno: Errno },
+    /// move_mount attaching the mount at the target.
+    MoveMount { target: PathBuf, errno: Errno },
+    /// Opening or entering the mount namespace, or returning to the
+    /// original one; what says which.
+    Namespace { what: String, errno: Errno },
+}
+
+impl MountError {
+    /// Returns the errno the failed step returned, for Rejected that of the
+    /// first rejected option.
+    pub fn errno(&self) -> Errno {
+        match self {
+            MountError::Rejected { errors, .. } => {
+                errors.first().map_or(Errno::INVAL, MountError::errno)
+            }
+            MountError::Fsopen { errno, .. }
+            | MountError::Fsconfig { errno, .. }
+            | MountError::Create { errno, .. }
+            | MountError::Fsmount { errno, .. }
+            | MountError::OpenDevice { errno, .. }
+            | MountError::OpenTree { errno, .. }
+            | MountError::MoveMount { errno, .. }
+            | MountError::Namespace { errno, .. } => *errno,
+        }
+    }
+}
+
+impl fmt::Display for MountError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            MountError::Fsopen { fstype, errno } => {
+                write!(f, "fsopen {} failed: {}", fstype, errno)
+            }
+            MountError::Fsconfig { option, errno, log } => {
+                write!(f, "fsconfig {} failed: {}", option, errno)?;
+                write_log(f, log)
+            }
+            MountError::Create { fstype, errno, log } => {
+                write!(f, "fsconfig create {} failed: {}", fstype, errno)?;
+                write_log(f, log)
+            }
+            MountError::Fsmount { errno, log } => {
+                write!(f, "fsmount failed: {}", errno)?;
+                write_log(f, log)
+            }
+            MountError::Rejected { fstype, errors } => {
+                write!(f, "{} option(s) rejected by {}: ", errors.len(), fstype)?;
+                for (i, err) in errors.iter().enumerate() {
+                    if i > 0 {
+                        f.write_str("; ")?;
+                    }
+                    match err {
+                        MountError::Fsconfig { option, errno, log } => {
+                            write!(f, "{}: {}", option, errno)?;
+                            write_log(f, log)?;
+                        }
+                        err => write!(f, "{}", err)?,
+                    }
+                }
+                Ok(())
+            }
+            MountError::OpenDevice { source, errno } => {
+                write!(
+                    f,
+                    "open source device {} read-write failed: {}",
+                    source, errno
+                )
+            }
+            MountError::OpenTree { source, errno } => {
+                write!(f, "open source {} failed: {}", source, errno)
+            }
+            MountError::MoveMount { errno, .. } => write!(f, "move_mount failed: {}", errno),
+            MountError::Namespace { what, errno } => write!(f, "{} failed: {}", what, errno),
+        }
+    }
+}
+
+/// Returns the symbolic name of errno, e.g. "EINVAL", for the errors the
+/// mount syscalls and the steps around them are known to fail with.
+pub fn errno_name(errno: Errno) -> Option<&'static str> {
+    let name = match errno.raw_os_error() {
+        libc::EPERM => "EPERM",
+        libc::ENOENT => "ENOENT",
+        libc::ESRCH => "ESRCH",
+        libc::EINTR => "EINTR",
+        libc::EIO => "EIO",
+        libc::ENXIO => "ENXIO",
+        libc::E2BIG => "E2BIG",
+        libc::EBADF => "EBADF",
+        libc::EAGAIN => "EAGAIN",
+        libc::ENOMEM => "ENOMEM",
+        libc::EACCES => "EACCES",
+        libc::EFAULT => "EFAULT",
+        libc::ENOTBLK => "ENOTBLK",
+        libc::EBUSY => "EBUSY",
+        libc::EEXIST => "EEXIST",
+        libc::EXDEV => "EXDEV",
+        libc::ENODEV => "ENODEV",
+        libc::ENOTDIR => "ENOTDIR",
+        libc::EISDIR => "EISDIR",
+        libc::EINVAL => "EINVAL",
+        libc::ENFILE => "ENFILE",
+        libc::EMFILE => "EMFILE",
+        libc::EFBIG => "EFBIG",
+        libc::ENOSPC => "ENOSPC",
+        libc::EROFS => "EROFS",
+        libc::EMLINK => "EMLINK",
+        libc::ERANGE => "ERANGE",
+        libc::ENAMETOOLONG => "ENAMETOOLONG",
+        libc::ENOSYS => "ENOSYS",
+        libc::ELOOP => "ELOOP",
+        libc::ENODATA => "ENODATA",
+        libc::EOVERFLOW => "EOVERFLOW",
+        libc::EUCLEAN => "EUCLEAN",
+        libc::EOPNOTSUPP => "EOPNOTSUPP",
+        libc::ENOTCONN => "ENOTCONN",
+        libc::ECONNREFUSED => "ECONNREFUSED",
+        libc::ETIMEDOUT => "ETIMEDOUT",
+        libc::ESTALE => "ESTALE",
+        libc::EDQUOT => "EDQUOT",
+        libc::ENOMEDIUM => "ENOMEDIUM",
+        libc::EMEDIUMTYPE => "EMEDIUMTYPE",
+        libc::ENOKEY => "ENOKEY",
+        libc::EKEYREJECTED => "EKEYREJECTED",
+        _ => return None,
+    };
+    Some(name)
+}
+
+fn write_log(f: &mut fmt::Formatter<'_>, log: &str) -> fmt::Result {
+    if log.is_empty() {
+        Ok(())
+    } else {
+        write!(f, ": {}", log)
+    }
+}
+
+impl std::error::Error for MountError {
+    fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
+        match self {
+            MountError::Rejected { errors, .. } => errors
+                .first()
+                .map(|err| err as &(dyn std::error::Error + 'static)),
+            MountError::Fsopen { errno, .. }
+            | MountError::Fsconfig { errno, .. }
+            | MountError::Create { errno, .. }
+            | MountError::Fsmount { errno, .. }
+            | MountError::OpenDevice { errno, .. }
+            | MountError::OpenTree { errno, .. }
+            | MountError::MoveMount { errno, .. }
+            | MountError::Namespace { errno, .. } => Some(errno),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn rejected(option: &str, errno: Errno, log: &str) -> MountError {
+        MountError::Fsconfig {
+            option: option.to_string(),
+            errno,
+            log: log.to_string(),
+        }
+    }
+
+    #[test]
+    fn rejected_lists_every_option() {
+        let err = MountError::Rejected {
+            fstype: "tmpfs".to_string(),
+            errors: vec![
+                rejected("bogus", Errno::INVAL, "tmpfs: Unknown parameter 'bogus'"),
+                rejected("size=huge", Errno::INVAL, ""),
+                rejected("quota", Errno::OPNOTSUPP, "tmpfs: quota not supported"),
+            ],
+        };
+        assert_eq!(
+            err.to_string(),
+            format!(
+                "3 option(s) rejected by tmpfs: bogus: {inval}: tmpfs: Unknown parameter 'bogus'; \
+                 size=huge: {inval}; quota: {notsup}: tmpfs: quota not supported",
+                inval = Errno::INVAL,
+                notsup = Errno::OPNOTSUPP
+            )
+        );
+        // The first rejection stands for the whole
+        assert_eq!(err.errno(), Errno::INVAL);
+        assert!(std::error::Error::source(&err).is_some());
+    }
+
+    #[test]
+    fn single_fsconfig_error() {
+        let err = rejected("bogus", Errno::INVAL, "tmpfs: Unknown parameter 'bogus'");
+        assert_eq!(
+            err.to_string(),
+            format!(
+                "fsconfig bogus failed: {}: tmpfs: Unknown parameter 'bogus'",
+                Errno::INVAL
+            )
+        );
+    }
+
+    #[test]
+    fn errno_names() {
+        assert_eq!(errno_name(Errno::INVAL), Some("EINVAL"));
+        assert_eq!(errno_name(Errno::PERM), Some("EPERM"));
+        assert_eq!(errno_name(Errno::OPNOTSUPP), Some("EOPNOTSUPP"));
+        assert_eq!(errno_name(Errno::from_raw_os_error(4095)), None);
+    }
+}
@@ -0,0 +1,130 @@
+//! Handing a configured fs context to another process over a unix socket.
+//!
+//! The fd travels as SCM_RIGHTS ancillary data, with the filesystem type as
+//! the message body. The receiver only accepts senders running as its own
+//! user or root, and treats the type as a claim to check against the mount.
+
+use rustix::net::sockopt::get_socket_peercred;
+use rustix::net::{
+    recvmsg, sendmsg, RecvAncillaryBuffer, RecvAncillaryMessage, RecvFlags, SendAncillaryBuffer,
+    SendAncillaryMessage, SendFlags,
+};
+use rustix::process::geteuid;
+use std::io::{IoSlice, IoSliceMut};
+use std::os::fd::{AsFd, BorrowedFd, OwnedFd};
+use std::os::unix::net::{UnixListener, UnixStream};
+
+/// Longest filesystem type name accepted from the sender.
+const MAX_FSTYPE_LEN: usize = 256;
+
+/// Connects to the socket at path and sends fd along with fstype.
+pub fn send(path: &str, fd: BorrowedFd<'_>, fstype: &str) -> Result<(), String> {
+    let stream =
+        UnixStream::connect(path).map_err(|e| format!("connect to {} failed: {}", path, e))?;
+    let fds = [fd];
+    let mut space = [0; rustix::cmsg_space!(ScmRights(1))];
+    let mut control = SendAncillaryBuffer::new(&mut space);
+    control.push(SendAncillaryMessage::ScmRights(&fds));
+    sendmsg(
+        stream.as_fd(),
+        &[IoSlice::new(fstype.as_bytes())],
+        &mut control,
+        SendFlags::empty(),
+    )
+    .map_err(|e| format!("sending fd to {} failed: {}", path, e))?;
+    Ok(())
+}
+
+/// Listens on a new socket at path, waits for one sender and returns the fd
+/// and filesystem type it sent. The socket file is removed again afterwards.
+/// Senders running as another user than ours or root are refused.
+pub fn recv(path: &str) -> Result<(OwnedFd, String), String> {
+    let listener =
+        UnixListener::bind(path).map_err(|e| format!("listen on {} failed: {}", path, e))?;
+    let accepted = listener.accept();
+    let _ = std::fs::remove_file(path);
+    let (stream, _) = accepted.map_err(|e| format!("accept on {} failed: {}", path, e))?;
+    let peer = get_socket_peercred(&stream)
+        .map_err(|e| format!("reading peer credentials on {} failed: {}", path, e))?;
+    check_peer(peer.uid.as_raw(), geteuid().as_raw()).map_err(|e| {
+        format!(
+            "refusing fs context on {} from pid {}: {}",
+            path,
+            peer.pid.as_raw_nonzero(),
+            e
+        )
+    })?;
+
+    let mut buf = [0; MAX_FSTYPE_LEN];
+    let mut space = [0; rustix::cmsg_space!(ScmRights(1))];
+    let mut control = RecvAncillaryBuffer::new(&mut space);
+    let msg = recvmsg(
+        stream.as_fd(),
+        &mut [IoSliceMut::new(&mut buf)],
+        &mut control,
+        RecvFlags::CMSG_CLOEXEC,
+    )
+    .map_err(|e| format!("receiving fs context on {} failed: {}", path, e))?;
+    let fd = control
+        .drain()
+        .find_map(|msg| match msg {
+            RecvAncillaryMessage::ScmRights(mut fds) => fds.next(),
+            _ => None,
+        })
+        .ok_or_else(|| format!("no fs context fd received on {}", path))?;
+    let fstype = std::str::from_utf8(&buf[..msg.bytes])
+        .map_err(|_| format!("filesystem type received on {} is not UTF-8", path))?;
+    if fstype.is_empty() {
+        return Err(format!("no filesystem type received on {}", path));
+    }
+    Ok((fd, fstype.to_string()))
+}
+
+/// Checks that a sender running as peer may hand us an fs context.
+fn check_peer(peer: u32, own: u32) -> Result<(), String> {
+    if peer == own || peer == 0 {
+        return Ok(());
+    }
+    Err(format!("sender runs as uid {}, not {}", peer, own))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::os::fd::AsRawFd;
+    use std::path::Path;
+
+    #[test]
+    fn peer_must_be_us_or_root() {
+        assert!(check_peer(1000, 1000).is_ok());
+        assert!(check_peer(0, 1000).is_ok());
+        let err = check_peer(1001, 1000).unwrap_err();
+        assert_eq!(err, "sender runs as uid 1001, not 1000");
+    }
+
+    #[test]
+    fn recv_takes_fd_and_claim_from_own_user() {
+        let path = std::env::temp_dir().join(format!("mic-fdpass-{}", std::process::id()));
+        let path = path.to_str().unwrap().to_string();
+        let _ = std::fs::remove_file(&path);
+        let receiver = {
+            let path = path.clone();
+            std::thread::spawn(move || recv(&path))
+        };
+        let file = std::fs::File::open("/dev/null").unwrap();
+        // Wait for the listener to bind before sending
+        let mut sent = Err(String::new());
+        for _ in 0..100 {
+            sent = send(&path, file.as_fd(), "tmpfs");
+            if sent.is_ok() {
+                break;
+            }
+            std::thread::sleep(std::time::Duration::from_millis(10));
+        }
+        sent.unwrap();
+        let (fd, fstype) = receiver.join().unwrap().unwrap();
+        assert_eq!(fstype, "tmpfs");
+        assert_ne!(fd.as_raw_fd(), file.as_raw_fd());
+        assert!(!Path::new(&path).exists());
+    }
+}
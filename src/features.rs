@@ -0,0 +1,111 @@
+//! Discovering which mount APIs the running kernel provides.
+
+use rustix::io::Errno;
+use serde::Serialize;
+
+use crate::options::KernelVersion;
+
+/// Availability of each mount API on the running kernel.
+#[derive(Debug, Serialize)]
+pub struct Features {
+    /// fsopen, fsconfig and fsmount, needed for --fstype.
+    pub fsopen: bool,
+    /// open_tree, needed for bind mounts.
+    pub open_tree: bool,
+    /// mount_setattr, needed for --then-ro.
+    pub mount_setattr: bool,
+    /// Idmapped mounts (MOUNT_ATTR_IDMAP).
+    pub idmap: bool,
+    /// statmount, for querying a single mount by ID.
+    pub statmount: bool,
+    /// listmount, for enumerating mounts by ID.
+    pub listmount: bool,
+    /// MOVE_MOUNT_BENEATH, for attaching under an existing mount.
+    pub move_mount_beneath: bool,
+}
+
+impl Features {
+    /// Probes the running kernel. Syscalls that libc knows the number of are
+    /// probed directly; the rest are judged by the kernel version that
+    /// introduced them.
+    pub fn probe() -> Result<Features, String> {
+        Ok(Features::assemble(KernelVersion::running()?, has_syscall))
+    }
+
+    /// Fills in the features for a kernel of the given version on which
+    /// has_syscall reports the syscalls that are implemented.
+    fn assemble(kernel: KernelVersion, has_syscall: impl Fn(libc::c_long) -> bool) -> Features {
+        let since = |major, minor| kernel >= KernelVersion { major, minor };
+        Features {
+            fsopen: has_syscall(libc::SYS_fsopen),
+            open_tree: has_syscall(libc::SYS_open_tree),
+            mount_setattr: has_syscall(libc::SYS_mount_setattr),
+            idmap: since(5, 12),
+            statmount: since(6, 8),
+            listmount: since(6, 8),
+            move_mount_beneath: since(6, 5),
+        }
+    }
+}
+
+/// Reports whether the kernel implements syscall nr, by calling it with an
+/// invalid fd and null pointers so that it fails without doing anything.
+/// Only ENOSYS means it is missing; EPERM from a seccomp filter counts as
+/// present.
+fn has_syscall(nr: libc::c_long) -> bool {
+    // SAFETY: every argument is an invalid fd, a null pointer or zero, which
+    // the mount syscalls reject before touching memory.
+    let ret = unsafe { libc::syscall(nr, -1, 0, 0, 0, 0) };
+    ret >= 0 || Errno::from_io_error(&std::io::Error::last_os_error()) != Some(Errno::NOSYS)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn kernel(major: u32, minor: u32) -> KernelVersion {
+        KernelVersion { major, minor }
+    }
+
+    #[test]
+    fn features_serialize_as_booleans() {
+        let features = Features::assemble(kernel(6, 8), |_| true);
+        let json = serde_json::to_value(&features).unwrap();
+        let object = json.as_object().unwrap();
+        let keys: Vec<&str> = object.keys().map(String::as_str).collect();
+        assert_eq!(
+            keys,
+            [
+                "fsopen",
+                "idmap",
+                "listmount",
+                "mount_setattr",
+                "move_mount_beneath",
+                "open_tree",
+                "statmount",
+            ]
+        );
+        assert!(object.values().all(|v| v == &serde_json::Value::Bool(true)));
+    }
+
+    #[test]
+    fn syscalls_are_probed_and_the_rest_judged_by_version() {
+        let features = Features::assemble(kernel(5, 12), |nr| nr == libc::SYS_open_tree);
+        assert!(!features.fsopen);
+        assert!(features.open_tree);
+        assert!(!features.mount_setattr);
+        assert!(features.idmap);
+        assert!(!features.move_mount_beneath);
+        assert!(!features.statmount);
+        let features = Features::assemble(kernel(6, 5), |_| false);
+        assert!(features.move_mount_beneath);
+        assert!(!features.listmount);
+    }
+
+    #[test]
+    fn only_enosys_means_missing() {
+        assert!(has_syscall(libc::SYS_getpid));
+        // Past the end of the syscall table
+        assert!(!has_syscall(100_000));
+    }
+}
@@ -0,0 +1,315 @@
+//! A configured filesystem context that can be mounted more than once.
+
+use rustix::io::{read, Errno};
+use rustix::mount::{
+    fsconfig_create, fsconfig_reconfigure, fsconfig_set_fd, fsconfig_set_string, fsmount, fsopen,
+    fspick, FsMountFlags, FsOpenFlags, FsPickFlags, MountAttrFlags,
+};
+use std::cell::OnceCell;
+use std::os::fd::{AsFd, BorrowedFd, OwnedFd};
+use std::path::Path;
+
+use crate::attrs;
+use crate::options::FsOption;
+use crate::sys::{attach, clone_mount, retry_eintr};
+
+/// Wraps the fd returned by fsopen.
+///
+/// Set the source and options and call create once. fsmount can then be
+/// called once per context (a second call fails with EBUSY), so to mount
+/// the filesystem at several targets call mount for each: the first makes
+/// the mount with fsmount, the others attach open_tree clones of it. Every
+/// mount shares the same superblock, so e.g. two tmpfs targets mounted from
+/// one context share their contents. The context is closed when dropped.
+pub struct FsContext {
+    fd: OwnedFd,
+    /// The mount from the first call to mount, which later calls clone.
+    mounted: OnceCell<OwnedFd>,
+}
+
+impl FsContext {
+    pub fn open(fstype: &str) -> rustix::io::Result<FsContext> {
+        let fd = retry_eintr(|| fsopen(fstype, FsOpenFlags::FSOPEN_CLOEXEC))?;
+        Ok(FsContext {
+            fd,
+            mounted: OnceCell::new(),
+        })
+    }
+
+    /// Opens a context for the filesystem mounted at path, which must be the
+    /// root of a mount, to change its options with reconfigure.
+    pub fn pick(path: &Path) -> rustix::io::Result<FsContext> {
+        let fd = retry_eintr(|| fspick(rustix::fs::CWD, path, FsPickFlags::FSPICK_CLOEXEC))?;
+        Ok(FsContext {
+            fd,
+            mounted: OnceCell::new(),
+        })
+    }
+
+    /// Wraps an fs context fd obtained elsewhere, e.g. from another process.
+    pub fn from_fd(fd: OwnedFd) -> FsContext {
+        FsContext {
+            fd,
+            mounted: OnceCell::new(),
+        }
+    }
+
+    pub fn set_source(&self, source: &str) -> rustix::io::Result<()> {
+        retry_eintr(|| fsconfig_set_string(self.fd.as_fd(), "source", source))
+    }
+
+    /// Sets source to an open fd with FSCONFIG_SET_FD, for a device opened
+    /// by the caller rather than looked up by path.
+    pub fn set_source_fd(&self, fd: BorrowedFd<'_>) -> rustix::io::Result<()> {
+        retry_eintr(|| fsconfig_set_fd(self.fd.as_fd(), "source", fd))
+    }
+
+    pub fn set_option(&self, opt: &FsOption) -> rustix::io::Result<()> {
+        retry_eintr(|| opt.apply(self.fd.as_fd()))
+    }
+
+    pub fn as_fd(&self) -> BorrowedFd<'_> {
+        self.fd.as_fd()
+    }
+
+    /// Issues FSCONFIG_CMD_CREATE, after which no more options can be set.
+    ///
+    /// Not retried on EINTR: the kernel marks a context whose create failed
+    /// as failed, and a second create would only return EBUSY.
+    pub fn create(&self) -> rustix::io::Result<()> {
+        fsconfig_create(self.fd.as_fd())
+    }
+
+    /// Issues FSCONFIG_CMD_RECONFIGURE on a context from pick, applying the
+    /// options set since to the mounted filesystem. Not retried on EINTR for
+    /// the same reason as create.
+    pub fn reconfigure(&self) -> rustix::io::Result<()> {
+        fsconfig_reconfigure(self.fd.as_fd())
+    }
+
+    /// Creates a detached mount of the configured filesystem.
+    pub fn fsmount(&self, attrs: MountAttrFlags) -> rustix::io::Result<OwnedFd> {
+        retry_eintr(|| fsmount(self.fd.as_fd(), FsMountFlags::FSMOUNT_CLOEXEC, attrs))
+    }
+
+    /// Reads and clears the messages the kernel logged on the context, such
+    /// as "tmpfs: Unknown parameter 'foo'", joined with "; ". The kernel
+    /// prefixes each with "e ", "w " or "i " for its level; that is dropped.
+    pub fn drain_log(&self) -> String {
+        let mut messages = Vec::new();
+        let mut buf = [0u8; 4096];
+        // Each read returns one message, until ENODATA once the log is empty
+        while let Ok(n) = read(&self.fd, &mut buf) {
+            if n == 0 {
+                break;
+            }
+            let msg = String::from_utf8_lossy(&buf[..n]);
+            let msg = msg.trim_end();
+            messages.push(msg.get(2..).unwrap_or(msg).to_string());
+        }
+        messages.join("; ")
+    }
+
+    /// Formats an error from an operation on the context, followed by
+    /// whatever the kernel logged about it.
+    pub fn describe(&self, err: Errno) -> String {
+        let log = self.drain_log();
+        if log.is_empty() {
+            err.to_string()
+        } else {
+            format!("{}: {}", err, log)
+        }
+    }
+
+    /// Like fsmount, but if the filesystem rejects attrs with EINVAL or
+    /// EOPNOTSUPP, retries without each attribute in turn to find the one it
+    /// does not support. Returns the mount and the attribute that had to be
+    /// dropped, if any.
+    pub fn fsmount_relaxed(
+        &self,
+        attrs: MountAttrFlags,
+    ) -> rustix::io::Result<(OwnedFd, Option<(&'static str, MountAttrFlags)>)> {
+        relax(attrs, |attrs| self.fsmount(attrs))
+    }
+
+    /// Mounts the created filesystem at target in the current mount
+    /// namespace. The first call makes the mount with fsmount and attrs; a
+    /// context only allows one fsmount, so later calls attach clones of
+    /// that mount made with open_tree, which keep its attributes and
+    /// ignore attrs. Do not call fsmount on a context mounted this way.
+    pub fn mount(&self, target: &Path, attrs: MountAttrFlags) -> rustix::io::Result<()> {
+        mount_once(
+            &self.mounted,
+            target,
+            attrs,
+            |attrs| self.fsmount(attrs),
+            |first| clone_mount(first.as_fd()),
+            |fd, target| attach(fd.as_fd(), target),
+        )
+    }
+}
+
+/// The steps behind mount, with fsmount, open_tree and move_mount passed
+/// in. mounted holds the mount from the first call.
+fn mount_once<T>(
+    mounted: &OnceCell<T>,
+    target: &Path,
+    attrs: MountAttrFlags,
+    fsmount: impl FnOnce(MountAttrFlags) -> rustix::io::Result<T>,
+    clone: impl FnOnce(&T) -> rustix::io::Result<T>,
+    attach: impl Fn(&T, &Path) -> rustix::io::Result<()>,
+) -> rustix::io::Result<()> {
+    let Some(first) = mounted.get() else {
+        let mnt = fsmount(attrs)?;
+        attach(&mnt, target)?;
+        let _ = mounted.set(mnt);
+        return Ok(());
+    };
+    let clone = clone(first)?;
+    attach(&clone, target)
+}
+
+/// The search behind fsmount_relaxed, with fsmount passed in.
+fn relax<T>(
+    attrs: MountAttrFlags,
+    mut fsmount: impl FnMut(MountAttrFlags) -> rustix::io::Result<T>,
+) -> rustix::io::Result<(T, Option<(&'static str, MountAttrFlags)>)> {
+    let err = match fsmount(attrs) {
+        Ok(mnt) => return Ok((mnt, None)),
+        Err(e @ (Errno::INVAL | Errno::OPNOTSUPP)) => e,
+        Err(e) => return Err(e),
+    };
+    for (name, flag) in attrs::named_attrs(attrs) {
+        if let Ok(mnt) = fsmount(attrs - flag) {
+            return Ok((mnt, Some((name, flag))));
+        }
+    }
+    Err(err)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::cell::RefCell;
+
+    /// An fsmount that fails with EINVAL whenever attrs contains bad.
+    fn rejecting(
+        bad: MountAttrFlags,
+        tried: &mut Vec<MountAttrFlags>,
+    ) -> impl FnMut(MountAttrFlags) -> rustix::io::Result<MountAttrFlags> + '_ {
+        move |attrs| {
+            tried.push(attrs);
+            if attrs.contains(bad) {
+                Err(Errno::INVAL)
+            } else {
+                Ok(attrs)
+            }
+        }
+    }
+
+    #[test]
+    fn relax_keeps_accepted_attrs() {
+        let attrs = MountAttrFlags::MOUNT_ATTR_NOSUID | MountAttrFlags::MOUNT_ATTR_NODEV;
+        let mut tried = Vec::new();
+        let res = relax(
+            attrs,
+            rejecting(MountAttrFlags::MOUNT_ATTR_NOEXEC, &mut tried),
+        );
+        assert_eq!(res, Ok((attrs, None)));
+        assert_eq!(tried, [attrs]);
+    }
+
+    #[test]
+    fn relax_drops_the_rejected_attr() {
+        let attrs = MountAttrFlags::MOUNT_ATTR_NOSUID
+            | MountAttrFlags::MOUNT_ATTR_NOEXEC
+            | MountAttrFlags::MOUNT_ATTR_NOATIME;
+        let mut tried = Vec::new();
+        let (mounted, dropped) = relax(
+            attrs,
+            rejecting(MountAttrFlags::MOUNT_ATTR_NOATIME, &mut tried),
+        )
+        .unwrap();
+        assert_eq!(mounted, attrs - MountAttrFlags::MOUNT_ATTR_NOATIME);
+        assert_eq!(
+            dropped,
+            Some(("noatime", MountAttrFlags::MOUNT_ATTR_NOATIME))
+        );
+        assert_eq!(tried.len(), 4);
+    }
+
+    #[test]
+    fn relax_gives_up_with_the_first_error() {
+        let attrs = MountAttrFlags::MOUNT_ATTR_NOSUID | MountAttrFlags::MOUNT_ATTR_NODEV;
+        let mut tried = Vec::new();
+        // Dropping any one attribute does not help
+        let res = relax(attrs, rejecting(MountAttrFlags::empty(), &mut tried));
+        assert_eq!(res, Err(Errno::INVAL));
+        assert_eq!(tried.len(), 3);
+
+        // Errors other than EINVAL and EOPNOTSUPP are not worked around
+        let res = relax(attrs, |_| Err::<(), _>(Errno::PERM));
+        assert_eq!(res, Err(Errno::PERM));
+    }
+
+    /// Mounts target from a context whose mounts are named by the step
+    /// that made them, recording each step in steps.
+    fn mount_stub(
+        mounted: &OnceCell<String>,
+        target: &str,
+        steps: &RefCell<Vec<String>>,
+    ) -> rustix::io::Result<()> {
+        mount_once(
+            mounted,
+            Path::new(target),
+            MountAttrFlags::MOUNT_ATTR_NOSUID,
+            |attrs| {
+                assert_eq!(attrs, MountAttrFlags::MOUNT_ATTR_NOSUID);
+                steps.borrow_mut().push("fsmount".to_string());
+                Ok("fsmount".to_string())
+            },
+            |first| {
+                steps.borrow_mut().push(format!("clone {}", first));
+                Ok(format!("clone of {}", first))
+            },
+            |mnt, target| {
+                steps
+                    .borrow_mut()
+                    .push(format!("attach {} at {}", mnt, target.display()));
+                Ok(())
+            },
+        )
+    }
+
+    #[test]
+    fn mount_clones_the_first_mount_for_later_targets() {
+        let mounted = OnceCell::new();
+        let steps = RefCell::new(Vec::new());
+        mount_stub(&mounted, "/a", &steps).unwrap();
+        mount_stub(&mounted, "/b", &steps).unwrap();
+        assert_eq!(
+            steps.into_inner(),
+            [
+                "fsmount",
+                "attach fsmount at /a",
+                "clone fsmount",
+                "attach clone of fsmount at /b",
+            ]
+        );
+    }
+
+    #[test]
+    fn mount_keeps_no_mount_it_failed_to_attach() {
+        let mounted = OnceCell::new();
+        let res = mount_once(
+            &mounted,
+            Path::new("/a"),
+            MountAttrFlags::empty(),
+            |_| Ok("fsmount".to_string()),
+            |_| unreachable!(),
+            |_, _| Err(Errno::NOENT),
+        );
+        assert_eq!(res, Err(Errno::NOENT));
+        assert!(mounted.get().is_none());
+    }
+}
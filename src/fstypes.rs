@@ -0,0 +1,712 @@
+//! Knowledge about individual filesystem types.
+
+use crate::options::{FsOption, KernelVersion, ValueKind};
+use std::os::unix::fs::MetadataExt;
+
+/// Returns the statfs f_type magic reported by filesystems of the given type.
+pub fn magic(fstype: &str) -> Option<u32> {
+    let magic = match fstype {
+        // devtmpfs is tmpfs underneath and reports TMPFS_MAGIC
+        "tmpfs" | "devtmpfs" => 0x0102_1994,
+        "ramfs" => 0x8584_58f6,
+        "proc" => 0x9fa0,
+        "sysfs" => 0x6265_6572,
+        "devpts" => 0x1cd1,
+        "mqueue" => 0x1980_0202,
+        "cgroup2" => 0x6367_7270,
+        "overlay" => 0x794c_7630,
+        "fuse" => 0x6573_5546,
+        "ext2" | "ext3" | "ext4" => 0xef53,
+        "xfs" => 0x5846_5342,
+        "btrfs" => 0x9123_683e,
+        "squashfs" => 0x7371_7368,
+        "erofs" => 0xe0f5_e1e2,
+        "hugetlbfs" => 0x9584_58f6,
+        "bpf" => 0xcafe_4a11,
+        _ => return None,
+    };
+    Some(magic)
+}
+
+/// Filesystem types magic knows about.
+const MAGIC_TYPES: &[&str] = &[
+    "tmpfs",
+    "devtmpfs",
+    "ramfs",
+    "proc",
+    "sysfs",
+    "devpts",
+    "mqueue",
+    "cgroup2",
+    "overlay",
+    "fuse",
+    "ext2",
+    "ext3",
+    "ext4",
+    "xfs",
+    "btrfs",
+    "squashfs",
+    "erofs",
+    "hugetlbfs",
+    "bpf",
+];
+
+/// Names the filesystem type reporting f_type as its statfs magic. Some types
+/// share a magic, so hint is the answer whenever its magic is f_type.
+pub fn type_of_magic(f_type: u32, hint: &str) -> Option<&str> {
+    if magic(hint) == Some(f_type) {
+        return Some(hint);
+    }
+    MAGIC_TYPES
+        .iter()
+        .copied()
+        .find(|fstype| magic(fstype) == Some(f_type))
+}
+
+/// Checks that f_type, as statfs reports it for a mount, is the magic of
+/// fstype.
+pub fn check_magic(fstype: &str, f_type: u32) -> Result<(), String> {
+    let Some(expected) = magic(fstype) else {
+        return Err(format!("no known filesystem magic for fstype {}", fstype));
+    };
+    if f_type != expected {
+        return Err(format!(
+            "expected {:#x} ({}), got {:#x}",
+            expected, fstype, f_type
+        ));
+    }
+    Ok(())
+}
+
+/// Returns the option keys fstype accepts, apart from the generic source, or
+/// None for filesystems mic has no table for.
+pub fn known_options(fstype: &str) -> Option<&'static [&'static str]> {
+    let keys: &[&str] = match fstype {
+        "tmpfs" => &[
+            "size",
+            "nr_blocks",
+            "nr_inodes",
+            "mode",
+            "uid",
+            "gid",
+            "huge",
+            "mpol",
+            "inode32",
+            "inode64",
+            "noswap",
+            "quota",
+            "usrquota",
+            "grpquota",
+            "usrquota_block_hardlimit",
+            "usrquota_inode_hardlimit",
+            "grpquota_block_hardlimit",
+            "grpquota_inode_hardlimit",
+            "casefold",
+            "strict_encoding",
+        ],
+        "devtmpfs" => &["size", "nr_inodes", "mode"],
+        "ramfs" => &["mode"],
+        "devpts" => &["uid", "gid", "mode", "ptmxmode", "newinstance", "max"],
+        "proc" => &["hidepid", "gid", "subset"],
+        "sysfs" | "mqueue" => &[],
+        "cgroup2" => &[
+            "nsdelegate",
+            "favordynmods",
+            "memory_localevents",
+            "memory_recursiveprot",
+            "memory_hugetlb_accounting",
+            "pids_localevents",
+        ],
+        "overlay" => &[
+            "lowerdir",
+            "lowerdir+",
+            "datadir+",
+            "upperdir",
+            "workdir",
+            "default_permissions",
+            "redirect_dir",
+            "index",
+            "uuid",
+            "nfs_export",
+            "userxattr",
+            "xino",
+            "metacopy",
+            "verity",
+            "volatile",
+        ],
+        "fuse" => &[
+            "fd",
+            "rootmode",
+            "user_id",
+            "group_id",
+            "default_permissions",
+            "allow_other",
+            "max_read",
+            "blksize",
+            "subtype",
+        ],
+        "ext4" => &[
+            "acl",
+            "noacl",
+            "user_xattr",
+            "nouser_xattr",
+            "data",
+            "errors",
+            "commit",
+            "barrier",
+            "nobarrier",
+            "discard",
+            "nodiscard",
+            "delalloc",
+            "nodelalloc",
+            "dax",
+            "noload",
+            "journal_checksum",
+            "journal_async_commit",
+            "journal_dev",
+            "journal_path",
+            "resuid",
+            "resgid",
+            "sb",
+            "stripe",
+            "quota",
+            "usrquota",
+            "grpquota",
+            "prjquota",
+            "init_itable",
+            "noinit_itable",
+            "nombcache",
+        ],
+        "xfs" => &[
+            "allocsize",
+            "attr2",
+            "noattr2",
+            "dax",
+            "discard",
+            "nodiscard",
+            "inode32",
+            "inode64",
+            "largeio",
+            "nolargeio",
+            "logbufs",
+            "logbsize",
+            "logdev",
+            "rtdev",
+            "norecovery",
+            "nouuid",
+            "quota",
+            "uquota",
+            "gquota",
+            "pquota",
+            "prjquota",
+            "noquota",
+            "sunit",
+            "swidth",
+            "wsync",
+        ],
+        "btrfs" => &[
+            "subvol",
+            "subvolid",
+            "device",
+            "compress",
+            "compress-force",
+            "ssd",
+            "nossd",
+            "autodefrag",
+            "noautodefrag",
+            "discard",
+            "nodiscard",
+            "space_cache",
+            "clear_cache",
+            "degraded",
+            "commit",
+            "flushoncommit",
+            "noflushoncommit",
+            "thread_pool",
+            "max_inline",
+            "datacow",
+            "nodatacow",
+            "datasum",
+            "nodatasum",
+            "user_subvol_rm_allowed",
+            "skip_balance",
+            "rescue",
+            "fatal_errors",
+        ],
+        _ => return None,
+    };
+    Some(keys)
+}
+
+/// Security-module options the VFS hands to the LSM for any filesystem, so
+/// they are valid whatever the per-fstype table says.
+const LSM_OPTIONS: &[&str] = &[
+    "context",
+    "fscontext",
+    "defcontext",
+    "rootcontext",
+    "seclabel",
+];
+
+/// Superblock flags the VFS parses itself for every filesystem, which fsconfig
+/// accepts as flags whatever the filesystem.
+const GENERIC_OPTIONS: &[&str] = &[
+    "ro",
+    "rw",
+    "sync",
+    "async",
+    "dirsync",
+    "lazytime",
+    "nolazytime",
+    "mand",
+    "nomand",
+    "silent",
+];
+
+/// Checks that opt is one of the keys known for fstype. Filesystems without a
+/// table are not checked, since mic cannot tell what they accept.
+pub fn check_known(fstype: &str, opt: &FsOption) -> Result<(), String> {
+    let Some(keys) = known_options(fstype) else {
+        return Ok(());
+    };
+    let key = opt.key.as_str();
+    if keys.contains(&key) || GENERIC_OPTIONS.contains(&key) || LSM_OPTIONS.contains(&key) {
+        return Ok(());
+    }
+    Err(format!("option {} is not valid for fstype {}", key, fstype))
+}
+
+/// Options set for fstype unless an -o with the same key is given. Mounting
+/// devpts with the kernel defaults (mode=0600,ptmxmode=0000) leaves a
+/// namespace where nobody but root can open /dev/ptmx.
+fn default_options(fstype: &str) -> &'static [(&'static str, Option<&'static str>)] {
+    match fstype {
+        "devpts" => &[
+            ("newinstance", None),
+            ("mode", Some("0620")),
+            ("ptmxmode", Some("0666")),
+        ],
+        "devtmpfs" => &[("mode", Some("0755"))],
+        _ => &[],
+    }
+}
+
+/// Returns options with the defaults for fstype that it does not override
+/// placed in front. Only options for which applies holds override a
+/// default, so e.g. an `@ns mode=0600` does not drop devpts's mode=0620
+/// from a mount in the current namespace.
+pub fn with_defaults(
+    fstype: &str,
+    options: &[FsOption],
+    applies: impl Fn(&FsOption) -> bool,
+) -> Vec<FsOption> {
+    let mut merged: Vec<FsOption> = default_options(fstype)
+        .iter()
+        .filter(|(key, _)| !options.iter().any(|opt| opt.key == *key && applies(opt)))
+        .map(|(key, value)| FsOption {
+            key: key.to_string(),
+            value: value.map(str::to_string),
+            min_kernel: None,
+            in_namespace: None,
+            kind: ValueKind::String,
+        })
+        .collect();
+    merged.extend(options.iter().cloned());
+    merged
+}
+
+/// Returns options with the rootmode, user_id and group_id fuse requires
+/// placed in front, unless given: a directory root, owned by the real user
+/// and group of mic.
+pub fn fuse_options(options: &[FsOption]) -> Vec<FsOption> {
+    let ids = [
+        ("rootmode", "40000".to_string()),
+        ("user_id", rustix::process::getuid().as_raw().to_string()),
+        ("group_id", rustix::process::getgid().as_raw().to_string()),
+    ];
+    let mut merged: Vec<FsOption> = ids
+        .into_iter()
+        .filter(|(key, _)| !options.iter().any(|opt| opt.key == *key))
+        .map(|(key, value)| FsOption {
+            key: key.to_string(),
+            value: Some(value),
+            min_kernel: None,
+            in_namespace: None,
+            kind: ValueKind::String,
+        })
+        .collect();
+    merged.extend(options.iter().cloned());
+    merged
+}
+
+/// Checks the value of an option whose format mic knows for fstype, so that
+/// mistakes are reported before the kernel's bare EINVAL.
+pub fn check_option(fstype: &str, opt: &FsOption) -> Result<(), String> {
+    match (fstype, opt.key.as_str()) {
+        ("devpts", "mode" | "ptmxmode") | ("devtmpfs", "mode") => {
+            let value = opt.value.as_deref().unwrap_or_default();
+            match u32::from_str_radix(value, 8) {
+                Ok(mode) if mode <= 0o777 => Ok(()),
+                _ => Err(format!(
+                    "{} option {}: expected an octal mode like 0620, got {:?}",
+                    fstype, opt.key, value
+                )),
+            }
+        }
+        ("devpts", "uid" | "gid") => {
+            let value = opt.value.as_deref().unwrap_or_default();
+            match value.parse::<u32>() {
+                Ok(_) => Ok(()),
+                Err(_) => Err(format!(
+                    "{} option {}: expected a numeric id, got {:?}",
+                    fstype, opt.key, value
+                )),
+            }
+        }
+        ("tmpfs" | "devtmpfs", "size") => parse_size(opt.value.as_deref().unwrap_or_default())
+            .map(drop)
+            .map_err(|e| format!("{} option size: {}", fstype, e)),
+        ("tmpfs" | "devtmpfs", "nr_inodes") => {
+            parse_nr_inodes(opt.value.as_deref().unwrap_or_default())
+                .map(drop)
+                .map_err(|e| format!("{} option nr_inodes: {}", fstype, e))
+        }
+        ("devpts", "newinstance") if opt.value.is_some() => Err(format!(
+            "{} option newinstance does not take a value",
+            fstype
+        )),
+        _ => Ok(()),
+    }
+}
+
+/// Checks a tmpfs size: a number of bytes with an optional k, m, g, t, p or
+/// e suffix, as in 256M, or a percentage of RAM, as in 50%. Returns it
+/// unchanged for --size.
+pub fn parse_size(value: &str) -> Result<String, String> {
+    let valid = match value.strip_suffix('%') {
+        Some(percent) => is_number(percent),
+        None => is_number(strip_unit(value)),
+    };
+    if !valid {
+        return Err(format!(
+            "expected bytes with an optional k, m, g, t, p or e suffix, or a percentage like 50%, got {:?}",
+            value
+        ));
+    }
+    Ok(value.to_string())
+}
+
+/// Checks a tmpfs nr_inodes: a number with an optional k, m, g, t, p or e
+/// suffix, as in 1m. Unlike size, it cannot be a percentage. Returns it
+/// unchanged for --nr-inodes.
+pub fn parse_nr_inodes(value: &str) -> Result<String, String> {
+    if !is_number(strip_unit(value)) {
+        return Err(format!(
+            "expected a number with an optional k, m, g, t, p or e suffix, got {:?}",
+            value
+        ));
+    }
+    Ok(value.to_string())
+}
+
+/// Removes the binary unit suffix the kernel's memparse accepts, if any.
+fn strip_unit(value: &str) -> &str {
+    value
+        .strip_suffix(|c: char| "kmgtpeKMGTPE".contains(c))
+        .unwrap_or(value)
+}
+
+/// Reports whether s is a decimal number that fits in 64 bits.
+fn is_number(s: &str) -> bool {
+    s.bytes().all(|b| b.is_ascii_digit()) && s.parse::<u64>().is_ok()
+}
+
+/// The first kernel whose overlay takes its layers as fds.
+const OVERLAY_LAYER_FDS: KernelVersion = KernelVersion {
+    major: 6,
+    minor: 13,
+};
+
+/// Builds the overlay options for the given layers on kernel. From 6.13
+/// every layer is passed as a directory fd: one lowerdir+ per lower layer,
+/// topmost first, then upperdir and workdir if given. Older kernels only
+/// take strings, so the lower layers are joined with ':' into lowerdir,
+/// escaping ':' and '\' within a layer. upperdir and workdir must be on the
+/// same filesystem, which is checked here since the kernel only says
+/// EINVAL.
+pub fn overlay_options(
+    lower: &[String],
+    upper: Option<&str>,
+    work: Option<&str>,
+    kernel: KernelVersion,
+) -> Result<Vec<FsOption>, String> {
+    let (lower_key, kind) = if kernel >= OVERLAY_LAYER_FDS {
+        ("lowerdir+", ValueKind::DirFd)
+    } else {
+        ("lowerdir", ValueKind::String)
+    };
+    let mut options: Vec<(&str, String)> = if kind == ValueKind::DirFd {
+        lower.iter().map(|dir| (lower_key, dir.clone())).collect()
+    } else {
+        let escaped: Vec<String> = lower
+            .iter()
+            .map(|dir| dir.replace('\\', "\\\\").replace(':', "\\:"))
+            .collect();
+        vec![(lower_key, escaped.join(":"))]
+    };
+    if let (Some(upper), Some(work)) = (upper, work) {
+        let dev = |dir: &str| {
+            std::fs::metadata(dir)
+                .map(|md| md.dev())
+                .map_err(|e| format!("stat {} failed: {}", dir, e))
+        };
+        if dev(upper)? != dev(work)? {
+            return Err(format!(
+                "overlay upperdir {} and workdir {} are on different filesystems",
+                upper, work
+            ));
+        }
+        options.push(("upperdir", upper.to_string()));
+        options.push(("workdir", work.to_string()));
+    }
+    Ok(options
+        .into_iter()
+        .map(|(key, value)| FsOption {
+            key: key.to_string(),
+            value: Some(value),
+            min_kernel: None,
+            in_namespace: None,
+            kind,
+        })
+        .collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn tmpfs_magic() {
+        assert_eq!(magic("tmpfs"), Some(0x0102_1994));
+        assert_eq!(magic("devtmpfs"), magic("tmpfs"));
+        assert_eq!(magic("nosuchfs"), None);
+    }
+
+    #[test]
+    fn magic_types_are_known() {
+        for fstype in MAGIC_TYPES {
+            assert!(magic(fstype).is_some(), "{}", fstype);
+        }
+    }
+
+    #[test]
+    fn type_of_magic_prefers_hint() {
+        assert_eq!(type_of_magic(0x0102_1994, "devtmpfs"), Some("devtmpfs"));
+        assert_eq!(type_of_magic(0x0102_1994, "ext4"), Some("tmpfs"));
+        assert_eq!(type_of_magic(0xef53, "ext3"), Some("ext3"));
+        assert_eq!(type_of_magic(0x1234, "tmpfs"), None);
+    }
+
+    #[test]
+    fn check_magic_compares() {
+        assert!(check_magic("tmpfs", 0x0102_1994).is_ok());
+        let err = check_magic("tmpfs", 0xef53).unwrap_err();
+        assert_eq!(err, "expected 0x1021994 (tmpfs), got 0xef53");
+        let err = check_magic("nosuchfs", 0x0102_1994).unwrap_err();
+        assert_eq!(err, "no known filesystem magic for fstype nosuchfs");
+    }
+
+    #[test]
+    fn option_tables() {
+        assert!(known_options("tmpfs").unwrap().contains(&"size"));
+        assert_eq!(known_options("sysfs"), Some(&[][..]));
+        assert_eq!(known_options("nosuchfs"), None);
+        for fstype in [
+            "tmpfs", "devtmpfs", "ramfs", "devpts", "proc", "sysfs", "mqueue", "cgroup2",
+            "overlay", "fuse", "ext4", "xfs", "btrfs",
+        ] {
+            let keys = known_options(fstype).unwrap();
+            // source is generic and listed nowhere
+            assert!(!keys.contains(&"source"), "{} lists source", fstype);
+            for (i, key) in keys.iter().enumerate() {
+                assert!(!keys[..i].contains(key), "{} lists {} twice", fstype, key);
+            }
+        }
+    }
+
+    fn known(fstype: &str, opt: &str) -> Result<(), String> {
+        check_known(fstype, &FsOption::parse(opt).unwrap())
+    }
+
+    #[test]
+    fn check_known_accepts_generic_options() {
+        for opt in [
+            "ro",
+            "rw",
+            "sync",
+            "lazytime",
+            "silent",
+            "context=system_u:object_r:tmp_t:s0",
+        ] {
+            assert!(known("tmpfs", opt).is_ok(), "{}", opt);
+            assert!(known("sysfs", opt).is_ok(), "{}", opt);
+        }
+        assert_eq!(
+            known("tmpfs", "journal_async_commit").unwrap_err(),
+            "option journal_async_commit is not valid for fstype tmpfs"
+        );
+        // Unknown filesystems are not checked
+        assert!(known("nosuchfs", "anything").is_ok());
+    }
+
+    #[test]
+    fn check_known_per_fstype() {
+        for (fstype, opt) in [
+            ("ext4", "journal_async_commit"),
+            ("xfs", "prjquota"),
+            ("xfs", "noquota"),
+            ("xfs", "norecovery"),
+            ("btrfs", "flushoncommit"),
+        ] {
+            assert!(known(fstype, opt).is_ok(), "{} {}", fstype, opt);
+        }
+        assert!(known("btrfs", "prjquota").is_err());
+    }
+
+    fn opts(list: &[&str]) -> Vec<FsOption> {
+        list.iter().map(|o| FsOption::parse(o).unwrap()).collect()
+    }
+
+    fn rendered(options: &[FsOption]) -> Vec<String> {
+        options.iter().map(ToString::to_string).collect()
+    }
+
+    #[test]
+    fn devpts_defaults_go_first() {
+        let merged = with_defaults("devpts", &opts(&["gid=5"]), |_| true);
+        assert_eq!(
+            rendered(&merged),
+            ["newinstance", "mode=0620", "ptmxmode=0666", "gid=5"]
+        );
+        let merged = with_defaults("devtmpfs", &[], |_| true);
+        assert_eq!(rendered(&merged), ["mode=0755"]);
+        assert!(with_defaults("tmpfs", &[], |_| true).is_empty());
+    }
+
+    #[test]
+    fn devpts_defaults_give_way_to_options() {
+        let merged = with_defaults("devpts", &opts(&["ptmxmode=0600", "mode=0600"]), |_| true);
+        assert_eq!(
+            rendered(&merged),
+            ["newinstance", "ptmxmode=0600", "mode=0600"]
+        );
+    }
+
+    #[test]
+    fn devpts_defaults_stay_unless_the_override_applies() {
+        let options = opts(&["@ns mode=0600", "@6.0 ptmxmode=0600"]);
+        // Mounting in the current namespace on a 5.x kernel
+        let applies = |opt: &FsOption| {
+            opt.applies_in(false) && opt.applies_to(KernelVersion::parse("5.15").unwrap())
+        };
+        let merged = with_defaults("devpts", &options, applies);
+        assert_eq!(
+            rendered(&merged),
+            [
+                "newinstance",
+                "mode=0620",
+                "ptmxmode=0666",
+                "mode=0600",
+                "ptmxmode=0600"
+            ]
+        );
+        let merged = with_defaults("devpts", &options, |opt| opt.applies_in(true));
+        assert_eq!(
+            rendered(&merged),
+            ["newinstance", "mode=0600", "ptmxmode=0600"]
+        );
+    }
+
+    #[test]
+    fn devpts_option_values() {
+        let check = |fstype, opt| check_option(fstype, &FsOption::parse(opt).unwrap());
+        for opt in ["mode=0620", "ptmxmode=666", "uid=0", "gid=5", "newinstance"] {
+            assert!(check("devpts", opt).is_ok(), "{}", opt);
+        }
+        assert_eq!(
+            check("devpts", "mode=0999").unwrap_err(),
+            "devpts option mode: expected an octal mode like 0620, got \"0999\""
+        );
+        assert!(check("devpts", "ptmxmode=01777").is_err());
+        assert!(check("devtmpfs", "mode=rwx").is_err());
+        assert_eq!(
+            check("devpts", "gid=tty").unwrap_err(),
+            "devpts option gid: expected a numeric id, got \"tty\""
+        );
+        assert_eq!(
+            check("devpts", "newinstance=1").unwrap_err(),
+            "devpts option newinstance does not take a value"
+        );
+    }
+
+    fn layers(kernel: KernelVersion, upper: Option<&str>, work: Option<&str>) -> Vec<String> {
+        let lower = ["/l:1".to_string(), "/l\\2".to_string()];
+        overlay_options(&lower, upper, work, kernel)
+            .unwrap()
+            .iter()
+            .map(|opt| format!("{:?} {}", opt.kind, opt))
+            .collect()
+    }
+
+    #[test]
+    fn overlay_layers_as_fds_from_6_13() {
+        let kernel = KernelVersion {
+            major: 6,
+            minor: 13,
+        };
+        assert_eq!(
+            layers(kernel, None, None),
+            ["DirFd lowerdir+=/l:1", "DirFd lowerdir+=/l\\2"]
+        );
+        let tmp = std::env::temp_dir();
+        let tmp = tmp.to_str().unwrap();
+        assert_eq!(
+            layers(kernel, Some(tmp), Some(tmp)),
+            [
+                "DirFd lowerdir+=/l:1".to_string(),
+                "DirFd lowerdir+=/l\\2".to_string(),
+                format!("DirFd upperdir={}", tmp),
+                format!("DirFd workdir={}", tmp),
+            ]
+        );
+    }
+
+    #[test]
+    fn overlay_layers_as_strings_before_6_13() {
+        let kernel = KernelVersion {
+            major: 6,
+            minor: 12,
+        };
+        assert_eq!(
+            layers(kernel, None, None),
+            ["String lowerdir=/l\\:1:/l\\\\2"]
+        );
+    }
+
+    #[test]
+    fn overlay_upper_and_work_share_a_filesystem() {
+        let kernel = KernelVersion {
+            major: 6,
+            minor: 13,
+        };
+        let err =
+            overlay_options(&["/l".to_string()], Some("/proc"), Some("/"), kernel).unwrap_err();
+        assert_eq!(
+            err,
+            "overlay upperdir /proc and workdir / are on different filesystems"
+        );
+        let err = overlay_options(&["/l".to_string()], Some("/nonexistent"), Some("/"), kernel)
+            .unwrap_err();
+        assert!(err.starts_with("stat /nonexistent failed: "), "{}", err);
+    }
+}
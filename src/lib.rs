@@ -0,0 +1,29 @@
+//! The building blocks of mic, usable without going through the CLI.
+//!
+//! [`mount::mount`] performs a complete mount, and the [`mount`] module
+//! exposes the steps it is made of, which the mic binary calls. The other
+//! modules expose the pieces below those for callers that need more control.
+
+// The config schema is one json! literal, deeper than the default allows
+#![recursion_limit = "256"]
+
+pub mod attrs;
+pub mod batch;
+pub mod caps;
+pub mod config;
+pub mod error;
+pub mod fdpass;
+pub mod features;
+pub mod fs_context;
+pub mod fstypes;
+pub mod log;
+pub mod mount;
+pub mod mountinfo;
+pub mod ns;
+pub mod options;
+pub mod output;
+pub mod schema;
+pub mod source;
+pub mod statmount;
+pub mod sys;
+pub mod uri;
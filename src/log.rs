@@ -0,0 +1,48 @@
+//! The step-by-step log written with --verbose.
+
+use std::fmt;
+use std::io::Write;
+use std::sync::Mutex;
+use std::time::SystemTime;
+
+/// Where each step of a mount is logged, if anywhere.
+///
+/// Every line starts with an RFC 3339 timestamp. A quiet log discards
+/// everything, so callers can log unconditionally.
+pub struct Log {
+    out: Option<Mutex<Box<dyn Write + Send>>>,
+}
+
+impl Log {
+    /// Returns a log that discards everything.
+    pub fn quiet() -> Log {
+        Log { out: None }
+    }
+
+    /// Returns a log that writes to out, e.g. `std::io::stderr()`.
+    pub fn to(out: impl Write + Send + 'static) -> Log {
+        Log {
+            out: Some(Mutex::new(Box::new(out))),
+        }
+    }
+
+    /// Writes one line. Write errors are ignored; logging never fails a
+    /// mount.
+    pub fn step(&self, msg: fmt::Arguments) {
+        let Some(out) = &self.out else {
+            return;
+        };
+        let now = humantime::format_rfc3339_micros(SystemTime::now());
+        if let Ok(mut out) = out.lock() {
+            let _ = writeln!(out, "{} {}", now, msg);
+        }
+    }
+}
+
+impl fmt::Debug for Log {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("Log")
+            .field("enabled", &self.out.is_some())
+            .finish()
+    }
+}
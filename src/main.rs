@@ -1,113 +1,3297 @@
-use clap::Parser;
-use nix::sched::{setns, CloneFlags};
-use rustix::mount::{move_mount, open_tree, MoveMountFlags, OpenTreeFlags};
-use std::os::fd::AsFd;
+use mic::{
+    attrs, batch, caps, config, error, fdpass, features, fs_context, fstypes, log, mount,
+    mountinfo, ns, options, output, schema, source, statmount, sys, uri,
+};
+
+use clap::{ArgGroup, Parser};
+use nix::sched::{setns, unshare, CloneFlags};
+use rustix::mount::{mount_change, unmount, MountAttrFlags, MountPropagationFlags, UnmountFlags};
+use std::os::fd::{AsFd, AsRawFd, OwnedFd};
 // use rustix::process::{setns, Namespace};
-use std::fs::File;
-use std::os::unix::fs::PermissionsExt;
-use std::path::Path;
+use rustix::fs::{Mode, OFlags};
+use rustix::io::{fcntl_setfd, Errno, FdFlags};
+use rustix::process::{geteuid, umask};
+use std::fs::{DirBuilder, File, OpenOptions};
+use std::io::{BufRead, IsTerminal, Write};
+use std::os::unix::fs::{DirBuilderExt, MetadataExt, OpenOptionsExt, PermissionsExt};
+use std::path::{Path, PathBuf};
 use std::process;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{mpsc, Arc, Mutex, OnceLock};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use attrs::AttrList;
+use config::{Config, Propagation};
+use error::MountError;
+use fs_context::FsContext;
+use log::Log;
+use mount::{MountOptions, Setting};
+use mountinfo::MountInfo;
+use ns::NamespaceGuard;
+use options::{FsOption, KernelVersion, ValueKind};
+use output::{Audit, BatchSummary, MountNode, MountResult, OutputFormat, Space};
+use uri::MountUri;
+
+/// Exit status when the mount was attached but --wait-ready timed out.
+const EXIT_NOT_READY: i32 = 3;
+
+/// Exit statuses for a failure at one of the steps of a mount, so that
+/// scripts can tell e.g. a rejected option from a missing capability. Any
+/// other failure exits with 1, and a usage error with clap's 2.
+const EXIT_FSOPEN: i32 = 10;
+const EXIT_FSCONFIG: i32 = 11;
+const EXIT_CREATE: i32 = 12;
+const EXIT_FSMOUNT: i32 = 13;
+const EXIT_MOVE_MOUNT: i32 = 14;
+const EXIT_NAMESPACE: i32 = 15;
+
+/// A failure message and the status mic exits with for it, with the errno
+/// of the syscall that failed, where there was one.
+#[derive(Debug)]
+struct Failure {
+    status: i32,
+    msg: String,
+    errno: Option<Errno>,
+}
+
+impl Failure {
+    fn new(status: i32, msg: String) -> Failure {
+        Failure {
+            status,
+            msg,
+            errno: None,
+        }
+    }
+
+    fn with_errno(self, errno: Errno) -> Failure {
+        Failure {
+            errno: Some(errno),
+            ..self
+        }
+    }
+}
+
+/// Any failure not attributed to a step exits with 1.
+impl From<String> for Failure {
+    fn from(msg: String) -> Failure {
+        Failure::new(1, msg)
+    }
+}
+
+/// Where each step is logged, set once the arguments are parsed.
+static LOG: OnceLock<Log> = OnceLock::new();
+
+/// How fail prints errors, set once the arguments are parsed.
+static ERROR_FORMAT: OnceLock<OutputFormat> = OnceLock::new();
 
 #[derive(Parser)]
 #[command(author, version, about)]
+#[command(group(ArgGroup::new("fs").args(["fstype", "uri", "recv_context", "reconfigure", "lowerdir", "fuse"])))]
 struct Args {
     /// Target mountpoint directory
-    #[arg(long)]
-    target: String,
+    #[arg(long, required_unless_present_any = ["list_options", "features", "print_schema", "uri", "send_context", "config_file"])]
+    target: Option<String>,
     /// Source device or path
-    #[arg(long)]
+    #[arg(long, default_value = "")]
     source: String,
-    /// Path to target mount namespace
+    /// Filesystem type to create with fsopen instead of bind mounting --source
+    #[arg(long)]
+    fstype: Option<String>,
+    /// Filesystem type, target, source and options in one, as <fstype>://<target>?<key>=<value>&...
+    #[arg(
+        long,
+        value_name = "URI",
+        conflicts_with_all = ["target", "source", "fstype"],
+        value_parser = MountUri::parse
+    )]
+    uri: Option<MountUri>,
+    /// Configure the fs context for --fstype, then send it to the mic listening on this socket instead of mounting
+    #[arg(
+        long,
+        value_name = "SOCKET",
+        requires = "fstype",
+        conflicts_with = "target"
+    )]
+    send_context: Option<String>,
+    /// Listen on this socket for a configured fs context from --send-context and create and mount it
+    #[arg(long, value_name = "SOCKET", conflicts_with_all = ["source", "options"])]
+    recv_context: Option<String>,
+    /// Filesystem option (key or key=value) passed to fsconfig, may be repeated
+    /// and prefixed with "@<version> " to require a minimum kernel version
+    #[arg(
+        short = 'o',
+        long = "option",
+        value_name = "OPTION",
+        requires = "fs",
+        value_parser = FsOption::parse
+    )]
+    options: Vec<FsOption>,
+    /// tmpfs size in bytes with an optional k, m, g, t, p or e suffix, or a percentage of RAM, e.g. 256M or 50%; the same as -o size=
+    #[arg(long, requires = "fstype", value_parser = fstypes::parse_size)]
+    size: Option<String>,
+    /// Most inodes tmpfs allows, with an optional k, m, g, t, p or e suffix, e.g. 1m; the same as -o nr_inodes=
+    #[arg(long, value_name = "N", requires = "fstype", value_parser = fstypes::parse_nr_inodes)]
+    nr_inodes: Option<String>,
+    /// Option set from a file's contents with FSCONFIG_SET_BINARY, as key=@<file>; applied after -o (repeatable)
+    #[arg(
+        long,
+        value_name = "KEY=@FILE",
+        requires = "fs",
+        value_parser = FsOption::parse_binary
+    )]
+    option_binary: Vec<FsOption>,
+    /// Option set to a path with FSCONFIG_SET_PATH, as key=<path>; applied after --option-binary (repeatable)
+    #[arg(
+        long,
+        value_name = "KEY=PATH",
+        requires = "fs",
+        value_parser = FsOption::parse_path
+    )]
+    option_path: Vec<FsOption>,
+    /// Option set to an O_PATH fd of a path with FSCONFIG_SET_PATH_EMPTY, as key=<path>; applied after --option-path (repeatable)
+    #[arg(
+        long,
+        value_name = "KEY=PATH",
+        requires = "fs",
+        value_parser = FsOption::parse_path_empty
+    )]
+    option_path_empty: Vec<FsOption>,
+    /// Option set to an O_RDWR fd of a path with FSCONFIG_SET_FD, as key=<path>, e.g. fd=/dev/fuse; applied after --option-path-empty (repeatable)
+    #[arg(
+        long,
+        value_name = "KEY=PATH",
+        requires = "fs",
+        value_parser = FsOption::parse_fd
+    )]
+    option_fd: Vec<FsOption>,
+    /// Mount an overlay with this lower layer, topmost first (repeatable)
+    #[arg(long, value_name = "DIR")]
+    lowerdir: Vec<String>,
+    /// Writable upper layer of the overlay; needs --workdir on the same filesystem
+    #[arg(long, value_name = "DIR", requires_all = ["lowerdir", "workdir"])]
+    upperdir: Option<String>,
+    /// Empty work directory for the overlay, on the same filesystem as --upperdir
+    #[arg(long, value_name = "DIR", requires_all = ["lowerdir", "upperdir"])]
+    workdir: Option<String>,
+    /// Mount a FUSE filesystem on a new /dev/fuse connection and hand the connection to its server with --fuse-socket or --post-mount-exec
+    #[arg(long, conflicts_with = "send_context")]
+    fuse: bool,
+    /// Send the /dev/fuse fd of --fuse to the server listening on this socket once the mount is attached
+    #[arg(long, value_name = "SOCKET", requires = "fuse")]
+    fuse_socket: Option<String>,
+    /// Split each -o option at commas, as mount(8) does, e.g. -o size=64M,mode=0755
+    #[arg(long, requires = "fs")]
+    split_options: bool,
+    /// Print the syscalls the mount would make instead of making them
+    #[arg(
+        long,
+        conflicts_with_all = ["reconfigure", "unmount", "send_context"]
+    )]
+    dry_run: bool,
+    /// Refuse to do anything if there are more than this many options, fstype defaults included
+    #[arg(long, value_name = "N")]
+    max_options: Option<usize>,
+    /// Refuse to do anything if an option key or value, with its terminating NUL, is longer than this many bytes, the most fsconfig copies by default
+    #[arg(long, value_name = "BYTES", default_value_t = options::MAX_OPTION_LEN)]
+    max_option_len: usize,
+    /// Apply every -o option and report all rejected ones together instead of stopping at the first
+    #[arg(long, requires = "fs")]
+    continue_on_option_error: bool,
+    /// Mount anyway when options were rejected
+    #[arg(long, requires = "continue_on_option_error")]
+    ignore_option_errors: bool,
+    /// Set source after the -o options instead of before them, for filesystems that need it last
+    #[arg(long, requires = "fs")]
+    source_last: bool,
+    /// Open --source read-write and pass the fd with FSCONFIG_SET_FD instead of the path
+    #[arg(long, requires_all = ["fstype", "source"])]
+    source_fd: bool,
+    /// Comma-separated mount attributes for fsmount, e.g. ro,nosuid,nodev,noexec,relatime
+    #[arg(long, requires = "fs", value_parser = attrs::parse_attr_list)]
+    attrs: Option<AttrList>,
+    /// Create the mount read-only, the same as adding ro to --attrs
+    #[arg(long, requires = "fs")]
+    readonly: bool,
+    /// Ignore set-user-ID and set-group-ID bits, the same as adding nosuid to --attrs
+    #[arg(long, requires = "fs")]
+    nosuid: bool,
+    /// Disallow access to device files, the same as adding nodev to --attrs
+    #[arg(long, requires = "fs")]
+    nodev: bool,
+    /// Disallow executing programs, the same as adding noexec to --attrs
+    #[arg(long, requires = "fs")]
+    noexec: bool,
+    /// Access time behavior, the same as adding it to --attrs
+    #[arg(long, requires = "fs", value_parser = ["relatime", "noatime", "strictatime", "nodiratime"])]
+    atime: Option<String>,
+    /// If fsmount rejects --attrs, retry without each attribute in turn and drop the one the filesystem does not support
+    #[arg(long, requires = "attrs")]
+    relax_attrs: bool,
+    /// Propagation type to give the mount after attaching it, recursively unless --no-recursive
+    #[arg(long, value_enum, conflicts_with_all = ["reconfigure", "unmount"])]
+    propagation: Option<Propagation>,
+    /// Make the mount idmapped with the id mapping of this user namespace, e.g. /proc/<pid>/ns/user
+    #[arg(long, value_name = "PATH", conflicts_with_all = ["reconfigure", "unmount"])]
+    userns: Option<String>,
+    /// After mounting, check that statfs on the target reports the magic of --fstype
+    #[arg(long, requires = "fs")]
+    verify_magic: bool,
+    /// Stack on a mount already exactly at the target with a warning, instead of failing
+    #[arg(long)]
+    warn_overmount: bool,
+    /// Unmount whatever is already mounted exactly at the target before attaching, instead of failing
+    #[arg(long, conflicts_with = "warn_overmount")]
+    force_create: bool,
+    /// Fail instead of warning, e.g. for --warn-overmount
+    #[arg(long, requires = "warn_overmount")]
+    strict: bool,
+    /// Make the mount the target resides on private before attaching, so the new mount does not propagate to its peers
+    #[arg(long)]
+    private_parent: bool,
+    /// After attaching, wait up to this long (e.g. 5s, 500ms) for the mount to answer statfs, e.g. for a FUSE daemon to finish initializing
+    #[arg(long, value_name = "DURATION", value_parser = humantime::parse_duration)]
+    wait_ready: Option<Duration>,
+    /// Give up after this long (e.g. 30s) if the mount hangs, e.g. in fsconfig create against an unresponsive server
+    #[arg(long, value_name = "DURATION", value_parser = humantime::parse_duration)]
+    timeout: Option<Duration>,
+    /// Do not check for CAP_SYS_ADMIN before mounting, e.g. where the kernel grants more than the effective set shows
     #[arg(long)]
+    skip_cap_check: bool,
+    /// Log each step (fsopen, fsconfig, fsmount, setns, move_mount, ...) to stderr with a timestamp
+    #[arg(short, long)]
+    verbose: bool,
+    /// Clone the mount at this path, which must be a mountpoint, and attach the clone at target instead of binding --source
+    #[arg(long, value_name = "PATH", conflicts_with_all = ["source", "fs", "allow_file_target"])]
+    clone_from: Option<String>,
+    /// Bind only the source mount itself, without the mounts below it
+    #[arg(long, conflicts_with = "fs")]
+    no_recursive: bool,
+    /// Allow binding a single file: a file --source onto a file --target, created empty if missing
+    #[arg(long, conflicts_with = "fs")]
+    allow_file_target: bool,
+    /// Retry creating the target up to this many times when it fails with ENOENT or EEXIST
+    #[arg(long, value_name = "N", default_value_t = 0)]
+    mkdir_retries: u32,
+    /// Clear the umask while creating target directories so they get exactly --mode
+    #[arg(long)]
+    mkdir_umask: bool,
+    /// Also create a missing target in the current namespace, before checking it
+    #[arg(long)]
+    mkdir: bool,
+    /// Permission bits, in octal, for the target and any directories created for it
+    #[arg(long, value_name = "MODE", default_value = "755", value_parser = parse_mode)]
+    mode: u32,
+    /// Refuse to mount unless the target directory is owned by this uid (e.g. 0 for root)
+    #[arg(long, value_name = "UID")]
+    require_owner: Option<u32>,
+    /// Run extra sanity checks on the request before mounting
+    #[arg(long)]
+    validate: bool,
+    /// Where procfs is mounted, for namespace and mountinfo lookups
+    #[arg(long, value_name = "DIR", default_value = "/proc")]
+    proc_path: String,
+    /// Path to target mount namespace
+    #[arg(long, default_value = "", conflicts_with = "new_namespace")]
     mount_namespace: String,
+    /// Enter the mount namespace of this process, the same as --mount-namespace /proc/<PID>/ns/mnt
+    #[arg(long, value_name = "PID", conflicts_with_all = ["mount_namespace", "new_namespace"])]
+    mount_namespace_pid: Option<u32>,
+    /// Join this user namespace (e.g. /proc/<PID>/ns/user) before creating the mount; there is no way back out of it
+    #[arg(long, value_name = "PATH", conflicts_with_all = ["timeout", "unmount", "reconfigure", "stat"])]
+    user_namespace: Option<String>,
+    /// Join this network namespace (e.g. /proc/<PID>/ns/net) before creating the mount, after any --user-namespace
+    #[arg(long, value_name = "PATH", conflicts_with_all = ["unmount", "reconfigure", "stat"])]
+    net_namespace: Option<String>,
+    /// Mount into a fresh private mount namespace instead of an existing one
+    #[arg(long)]
+    new_namespace: bool,
+    /// Make the new namespace's root recursively private so mounts do not propagate back to the host
+    #[arg(long, requires = "new_namespace")]
+    isolate: bool,
+    /// Also bind the new mount at this path after attaching it at target (repeatable)
+    #[arg(long, value_name = "PATH")]
+    also_at: Vec<String>,
+    /// Change the -o options of the filesystem mounted at --target instead of mounting
+    #[arg(
+        long,
+        conflicts_with_all = [
+            "source", "attrs", "verify_magic", "probe_options", "send_context", "unmount",
+            "new_namespace",
+        ]
+    )]
+    reconfigure: bool,
+    /// Unmount whatever is mounted at --target instead of mounting
+    #[arg(long, conflicts_with_all = ["fs", "source", "new_namespace"])]
+    unmount: bool,
+    /// Print the ID, parent, type, propagation, attributes, options and submounts of the mount at --target instead of mounting
+    #[arg(long, conflicts_with_all = ["fs", "source", "new_namespace", "unmount"])]
+    stat: bool,
+    /// Make the mount at --target read-only with mount_setattr instead of mounting, recursively unless --no-recursive
+    #[arg(long, conflicts_with_all = ["fs", "source", "new_namespace", "unmount", "stat"])]
+    remount_ro: bool,
+    /// With --unmount, detach the mount lazily (MNT_DETACH)
+    #[arg(long, requires = "unmount")]
+    detach: bool,
+    /// With --unmount, abort pending requests on filesystems that support it (MNT_FORCE)
+    #[arg(long, requires = "unmount")]
+    force: bool,
+    /// Ask on the terminal before --unmount --force or --force-create removes a mount, and refuse without one unless --yes
+    #[arg(long)]
+    confirm: bool,
+    /// Answer --confirm's question with yes, e.g. in scripts
+    #[arg(long, requires = "confirm")]
+    yes: bool,
+    /// Check which -o options (and source) the kernel accepts for --fstype, without mounting anything
+    #[arg(long, requires = "fs")]
+    probe_options: bool,
+    /// Print the total, free and available space of the new mount
+    #[arg(long)]
+    report_space: bool,
+    /// Print the inode of the mount namespace the mount was attached in
+    #[arg(long)]
+    report_namespace: bool,
+    /// Print the mount ID, parent mount ID and propagation of the new mount
+    #[arg(long)]
+    report_mount_id: bool,
+    /// Run this command (and the remaining arguments) after mounting; unmount if it fails
+    #[arg(long, value_name = "CMD", num_args = 1.., allow_hyphen_values = true)]
+    post_mount_exec: Vec<String>,
+    /// After mounting (and any --post-mount-exec), make the mount read-only and check that it is
+    #[arg(long)]
+    then_ro: bool,
+    /// Log the caller's mount and user namespaces and the target mount namespace to stderr
+    #[arg(long)]
+    audit_namespaces: bool,
+    /// Print the option keys known for a filesystem type, one per line, and exit
+    #[arg(long, value_name = "FSTYPE")]
+    list_options: Option<String>,
+    /// With --wait-ready, unmount again if the mount does not become ready in time
+    #[arg(long, requires = "wait_ready")]
+    teardown_on_not_ready: bool,
+    /// Print which mount APIs the running kernel supports as JSON and exit
+    #[arg(long)]
+    features: bool,
+    /// How to print the result of a successful mount
+    #[arg(long, value_enum, default_value_t = OutputFormat::Plain)]
+    output: OutputFormat,
+    /// Print a SHA-256 of the effective configuration and exit without mounting
+    #[arg(long)]
+    config_hash: bool,
+    /// Print a JSON Schema of the configuration --dump-config prints and exit
+    #[arg(long)]
+    print_schema: bool,
+    /// Print the resolved configuration as JSON and exit without mounting
+    #[arg(long)]
+    dump_config: bool,
+    /// Mount every entry of this file in order, one line of mic arguments per mount
+    #[arg(
+        long = "config",
+        value_name = "FILE",
+        conflicts_with_all = ["target", "uri", "fs", "source", "clone_from", "send_context"]
+    )]
+    config_file: Option<String>,
+    /// With --config, unmount the entries already mounted if a later one fails
+    #[arg(long, requires = "config_file")]
+    rollback: bool,
+}
+
+impl Args {
+    /// Reports whether these arguments mount something, rather than asking
+    /// for one of the modes that do something else instead.
+    fn mounts(&self) -> bool {
+        !(self.unmount
+            || self.reconfigure
+            || self.stat
+            || self.remount_ro
+            || self.dry_run
+            || self.probe_options
+            || self.features
+            || self.config_hash
+            || self.print_schema
+            || self.dump_config
+            || self.list_options.is_some()
+            || self.send_context.is_some())
+    }
+
+    /// Combines --attrs with the single-attribute flags into one mask.
+    fn attr_flags(&self) -> Result<MountAttrFlags, String> {
+        let mut attrs = self.attrs.unwrap_or_default();
+        for (set, flag) in [
+            (self.readonly, MountAttrFlags::MOUNT_ATTR_RDONLY),
+            (self.nosuid, MountAttrFlags::MOUNT_ATTR_NOSUID),
+            (self.nodev, MountAttrFlags::MOUNT_ATTR_NODEV),
+            (self.noexec, MountAttrFlags::MOUNT_ATTR_NOEXEC),
+        ] {
+            if set {
+                attrs.flags |= flag;
+            }
+        }
+        match &self.atime {
+            Some(atime) => attrs::with_atime(attrs, atime),
+            None => Ok(attrs.flags),
+        }
+    }
+
+    fn config(&self) -> Result<Config, String> {
+        let (target, source, fstype, options) = match &self.uri {
+            // -o options are applied after those from the URI
+            Some(uri) => (
+                uri.target.clone(),
+                uri.source.clone(),
+                Some(uri.fstype.clone()),
+                [
+                    uri.options.as_slice(),
+                    &self.options,
+                    &self.option_binary,
+                    &self.option_path,
+                    &self.option_path_empty,
+                    &self.option_fd,
+                ]
+                .concat(),
+            ),
+            None => (
+                self.target.clone().unwrap_or_default(),
+                self.clone_from
+                    .clone()
+                    .unwrap_or_else(|| self.source.clone()),
+                if !self.lowerdir.is_empty() {
+                    Some("overlay".to_string())
+                } else if self.fuse {
+                    Some("fuse".to_string())
+                } else {
+                    self.fstype.clone()
+                },
+                [
+                    self.options.as_slice(),
+                    &self.option_binary,
+                    &self.option_path,
+                    &self.option_path_empty,
+                    &self.option_fd,
+                ]
+                .concat(),
+            ),
+        };
+        let options = if self.split_options {
+            let mut split = Vec::new();
+            for option in &options {
+                split.extend(option.split_commas()?);
+            }
+            split
+        } else {
+            options
+        };
+        // The layers go first and are never split, since a path may contain
+        // a comma
+        let options = if self.lowerdir.is_empty() {
+            options
+        } else {
+            let mut layers = fstypes::overlay_options(
+                &self.lowerdir,
+                self.upperdir.as_deref(),
+                self.workdir.as_deref(),
+                KernelVersion::running()?,
+            )?;
+            layers.extend(options);
+            layers
+        };
+        let options = if self.fuse {
+            fstypes::fuse_options(&options)
+        } else {
+            options
+        };
+        // --size and --nr-inodes are plain -o entries from here on
+        let mut options = options;
+        for (key, value) in [("size", &self.size), ("nr_inodes", &self.nr_inodes)] {
+            let Some(value) = value else {
+                continue;
+            };
+            if !matches!(fstype.as_deref(), Some("tmpfs" | "devtmpfs")) {
+                return Err(format!(
+                    "--{} is only for tmpfs and devtmpfs",
+                    key.replace('_', "-")
+                ));
+            }
+            options.push(FsOption {
+                key: key.to_string(),
+                value: Some(value.clone()),
+                min_kernel: None,
+                in_namespace: None,
+                kind: ValueKind::String,
+            });
+        }
+        if self.fuse {
+            // Nothing would be left holding the connection once mic exits
+            if self.fuse_socket.is_none() && self.post_mount_exec.is_empty() {
+                return Err(
+                    "--fuse needs --fuse-socket or --post-mount-exec to hand the connection to a server"
+                        .to_string(),
+                );
+            }
+            if self.fuse_socket.is_none() && self.wait_ready.is_some() {
+                return Err(
+                    "--wait-ready with --fuse needs --fuse-socket, since --post-mount-exec only starts the server afterwards"
+                        .to_string(),
+                );
+            }
+        }
+        // A default only gives way to an option that will be applied
+        let namespaced = self.mount_namespace_pid.is_some()
+            || !self.mount_namespace.is_empty()
+            || self.new_namespace;
+        let kernel = if options.iter().any(|opt| opt.min_kernel.is_some()) {
+            Some(KernelVersion::running()?)
+        } else {
+            None
+        };
+        Ok(Config {
+            options: match &fstype {
+                Some(fstype) => fstypes::with_defaults(fstype, &options, |opt| {
+                    opt.applies_in(namespaced) && kernel.is_none_or(|kernel| opt.applies_to(kernel))
+                }),
+                None => options,
+            },
+            target,
+            source,
+            fstype,
+            max_options: self.max_options,
+            max_option_len: self.max_option_len,
+            continue_on_option_error: self.continue_on_option_error,
+            ignore_option_errors: self.ignore_option_errors,
+            source_last: self.source_last,
+            source_fd: self.source_fd,
+            attrs: self.attr_flags()?,
+            relax_attrs: self.relax_attrs,
+            userns: self.userns.clone(),
+            verify_magic: self.verify_magic,
+            warn_overmount: self.warn_overmount,
+            force_create: self.force_create,
+            strict: self.strict,
+            private_parent: self.private_parent,
+            wait_ready: self.wait_ready,
+            teardown_on_not_ready: self.teardown_on_not_ready,
+            recursive: !self.no_recursive,
+            allow_file_target: self.allow_file_target,
+            clone_from: self.clone_from.is_some(),
+            mkdir_retries: self.mkdir_retries,
+            mkdir_umask: self.mkdir_umask,
+            mkdir: self.mkdir,
+            mode: self.mode,
+            require_owner: self.require_owner,
+            validate: self.validate,
+            proc_path: self.proc_path.clone(),
+            mount_namespace: match self.mount_namespace_pid {
+                Some(pid) => pid_namespace(&self.proc_path, pid)?,
+                None => self.mount_namespace.clone(),
+            },
+            user_namespace: self.user_namespace.clone(),
+            net_namespace: self.net_namespace.clone(),
+            new_namespace: self.new_namespace,
+            isolate: self.isolate,
+            also_at: self.also_at.clone(),
+            send_context: self.send_context.clone(),
+            recv_context: self.recv_context.clone(),
+            then_ro: self.then_ro,
+            fuse: self.fuse,
+            fuse_socket: self.fuse_socket.clone(),
+            propagation: self.propagation,
+            // Allow `--post-mount-exec -- cmd` to set the command apart
+            post_mount_exec: match self.post_mount_exec.split_first() {
+                Some((first, rest)) if first == "--" => rest.to_vec(),
+                _ => self.post_mount_exec.clone(),
+            },
+        })
+    }
 }
 
 fn main() {
     let args = Args::parse();
+    let _ = ERROR_FORMAT.set(args.output);
+    if args.verbose {
+        let _ = LOG.set(Log::to(std::io::stderr()));
+    }
+    let outcome = match args.timeout {
+        Some(timeout) => run_with_timeout(args, timeout),
+        None => run(&args, &Cleanup::default()),
+    };
+    match outcome {
+        Ok(status) => process::exit(status),
+        Err(failure) => fail(failure),
+    }
+}
 
-    // Ensure target exists and is a directory
-    let target = Path::new(&args.target);
-    if !target.exists() || !target.is_dir() {
-        eprintln!(
-            "target does not exist or is not a directory: {}",
-            args.target
-        );
-        process::exit(1);
+/// Does what args ask for and returns the exit status, 0 or EXIT_NOT_READY.
+/// Every failure is returned rather than exiting on the spot, so the
+/// namespace guard and open fds are dropped before main reports it.
+fn run(args: &Args, cleanup: &Cleanup) -> Result<i32, Failure> {
+    if let Some(fstype) = &args.list_options {
+        let Some(keys) = fstypes::known_options(fstype) else {
+            return Err(format!("no option table for fstype {}", fstype).into());
+        };
+        for key in keys {
+            println!("{}", key);
+        }
+        return Ok(0);
     }
-    // Ensure source exists and is a directory
-    let source = Path::new(&args.source);
-    if !source.exists() || !source.is_dir() {
-        eprintln!(
-            "source does not exist or is not a directory: {}",
-            args.source
-        );
-        process::exit(1);
+    if args.print_schema {
+        match serde_json::to_string_pretty(&schema::config_schema()) {
+            Ok(json) => println!("{}", json),
+            Err(e) => {
+                return Err(format!("encoding schema failed: {}", e).into());
+            }
+        }
+        return Ok(0);
     }
-    let source_fd = match open_tree(
-        rustix::fs::CWD,
-        source,
-        OpenTreeFlags::OPEN_TREE_CLONE | OpenTreeFlags::AT_RECURSIVE,
-    ) {
-        Ok(fd) => fd,
-        Err(e) => {
-            eprintln!("open source {} failed: {}", args.source, e);
-            process::exit(1);
+    if let Some(path) = &args.config_file {
+        run_batch(path, args.rollback, args.output)?;
+        return Ok(0);
+    }
+    if args.features {
+        let probed = features::Features::probe()
+            .and_then(|f| serde_json::to_string_pretty(&f).map_err(|e| e.to_string()));
+        match probed {
+            Ok(json) => println!("{}", json),
+            Err(e) => {
+                return Err(format!("probing kernel features failed: {}", e).into());
+            }
+        }
+        return Ok(0);
+    }
+    let mut config = args.config()?;
+    if args.dump_config {
+        match serde_json::to_string_pretty(&config) {
+            Ok(json) => println!("{}", json),
+            Err(e) => {
+                return Err(format!("encoding config failed: {}", e).into());
+            }
+        }
+        return Ok(0);
+    }
+
+    // A new filesystem's source may be a dm device given as vg/lv. Bind
+    // sources are plain paths and are left alone.
+    if config.fstype.is_some() && !config.source.is_empty() {
+        config.source = source::resolve(&config.source)?;
+    }
+
+    if args.config_hash {
+        println!("{}", config.hash()?);
+        return Ok(0);
+    }
+
+    check_option_count(&config)?;
+    for opt in &config.options {
+        opt.check_len(config.max_option_len)?;
+    }
+
+    // Everything from here on but --stat and a --dry-run without
+    // --probe-options needs CAP_SYS_ADMIN, which is clearer to say up front
+    // than with the first syscall's EPERM. A joined user namespace may
+    // grant it where mic has none to begin with.
+    let dry_run = args.dry_run && !args.probe_options;
+    if !(args.skip_cap_check || args.stat || dry_run || config.user_namespace.is_some()) {
+        check_sys_admin(&config)?;
+    }
+
+    // The preparing half of a split mount stops once the context is handed
+    // over; creating and attaching it is up to the receiver.
+    if let Some(socket) = &config.send_context {
+        let fstype = config.fstype.as_deref().unwrap_or_default();
+        let (ctx, _) = configure_context(fstype, &config)?;
+        fdpass::send(socket, ctx.as_fd(), fstype)?;
+        return Ok(0);
+    }
+
+    if args.reconfigure {
+        match reconfigure_target(&config)? {
+            Some(applied) => println!("reconfigured {}: {}", config.target, applied.join(",")),
+            None => println!("{} has the requested options already", config.target),
+        }
+        return Ok(0);
+    }
+
+    if args.unmount {
+        if args.force && args.confirm {
+            confirm(&format!("force-unmount {}", config.target), args.yes)?;
+        }
+        let mut flags = UnmountFlags::empty();
+        flags.set(UnmountFlags::DETACH, args.detach);
+        flags.set(UnmountFlags::FORCE, args.force);
+        unmount_target(&config, flags)?;
+        return Ok(0);
+    }
+
+    if args.remount_ro {
+        remount_readonly(&config)?;
+        println!("made {} read-only", config.target);
+        return Ok(0);
+    }
+
+    if args.stat {
+        if !config.mount_namespace.is_empty() {
+            enter_namespace(&config.mount_namespace)?;
+        }
+        let stat = statmount::stat(
+            Path::new(&config.target),
+            &config.proc_thread_self("mountinfo"),
+        )?;
+        print!("{}", output::render_stat(&stat, args.output));
+        return Ok(0);
+    }
+
+    if args.dry_run {
+        if let Some(fstype) = &config.fstype {
+            check_options(fstype, &config)?;
+        }
+        let mut steps = plan(&config)?;
+        if args.probe_options {
+            let fstype = config.fstype.as_deref().unwrap_or_default();
+            steps.extend(probe_plan(fstype, &config));
+        }
+        for step in steps {
+            println!("{}", step);
+        }
+        if !args.probe_options {
+            return Ok(0);
+        }
+    }
+
+    if args.probe_options {
+        let fstype = config.fstype.as_deref().unwrap_or_default();
+        if !probe_options(fstype, &config) {
+            return Err("some options were rejected".to_string().into());
+        }
+        return Ok(0);
+    }
+
+    // Ensure target exists and is a directory, or for a single-file bind is
+    // a regular file or does not exist yet
+    let target = Path::new(&config.target);
+    let file_target = config.allow_file_target && Path::new(&config.source).is_file();
+    if config.mkdir && !target.exists() {
+        if let Err(e) = create_target(&config, file_target) {
+            return Err(format!("failed to create target {}: {}", config.target, e).into());
+        }
+    }
+    if file_target {
+        if target.exists() && !target.is_file() {
+            return Err(format!("target is not a regular file: {}", config.target).into());
         }
+    } else if !target.exists() || !target.is_dir() {
+        return Err(format!(
+            "target does not exist or is not a directory: {}",
+            config.target
+        )
+        .into());
+    }
+    // The connection is opened before any namespace is joined and handed
+    // to the server once the mount is attached
+    let fuse_dev = if config.fuse {
+        Some(open_fuse(&mut config.options)?)
+    } else {
+        None
     };
-    let orig_ns = match File::open("/proc/self/ns/mnt") {
-        Ok(f) => f,
-        Err(e) => {
-            eprintln!("open original mount namespace failed: {}", e);
-            process::exit(1);
+    let _closing_fuse = fuse_dev.as_ref().map(|dev| cleanup.close("/dev/fuse", dev));
+    // Open every namespace up front: after joining a user namespace, the
+    // caller's credentials may no longer be enough to open the others.
+    let user_ns = match &config.user_namespace {
+        Some(path) => Some(open_namespace("user", path)?),
+        None => None,
+    };
+    let net_ns = match &config.net_namespace {
+        Some(path) => Some(open_namespace("network", path)?),
+        None => None,
+    };
+    let mnt_ns = if config.mount_namespace.is_empty() {
+        None
+    } else {
+        Some(open_namespace("mount", &config.mount_namespace)?)
+    };
+    // The user namespace goes first, since the capabilities the others
+    // need are checked against it. Both are joined before fsopen so that the
+    // filesystem is created with the credentials and network it will be
+    // used with.
+    if let (Some(ns), Some(path)) = (&user_ns, &config.user_namespace) {
+        log().step(format_args!("setns to {}", path));
+        if let Err(e) = setns(ns, CloneFlags::CLONE_NEWUSER) {
+            let errno = Errno::from_raw_os_error(e as i32);
+            let note = capabilities_note(&config, errno);
+            let msg = format!("setns to {} failed: {}", path, e) + &note;
+            return Err(Failure::new(EXIT_NAMESPACE, msg).with_errno(errno));
+        }
+    }
+    if let (Some(ns), Some(path)) = (&net_ns, &config.net_namespace) {
+        log().step(format_args!("setns to {}", path));
+        if let Err(e) = setns(ns, CloneFlags::CLONE_NEWNET) {
+            let errno = Errno::from_raw_os_error(e as i32);
+            let note = capabilities_note(&config, errno);
+            let msg = format!("setns to {} failed: {}", path, e) + &note;
+            return Err(Failure::new(EXIT_NAMESPACE, msg).with_errno(errno));
+        }
+    }
+    // fsopen and open_tree need CAP_SYS_ADMIN over the current mount
+    // namespace, which the joined user namespace only has over its own, so
+    // with one the mount namespace is entered before creating the mount.
+    let joined_user_ns = user_ns.is_some();
+    if joined_user_ns {
+        enter_mount_namespace(&config, mnt_ns.as_ref())?;
+    }
+    // Create the detached mount, a new filesystem or a clone of the bind
+    // source, while still in the original namespace where --source resolves.
+    // Only the move_mount happens in the target namespace, so there is a
+    // single step there that either attaches the finished mount or fails.
+    let mut applied = Vec::new();
+    let mut attrs = config.attrs;
+    let mnt_fd: OwnedFd = if let Some(socket) = &config.recv_context {
+        let (fd, claimed) = fdpass::recv(socket)?;
+        log().step(format_args!(
+            "received fs context claimed to be {} from {} as fd {}",
+            claimed,
+            socket,
+            fd.as_raw_fd()
+        ));
+        let ctx = FsContext::from_fd(fd);
+        let _closing = cleanup.close("fs context", ctx.as_fd());
+        let mnt_fd = mount_context(&ctx, &claimed, &config, &mut attrs)?;
+        // The sender's word is not proof; name the type from the mount itself
+        let st = rustix::fs::fstatfs(&mnt_fd)
+            .map_err(|e| format!("statfs of fs context from {} failed: {}", socket, e))?;
+        let f_type = st.f_type as u32;
+        let fstype = fstypes::type_of_magic(f_type, &claimed).ok_or_else(|| {
+            format!(
+                "fs context from {} has unknown filesystem magic {:#x}",
+                socket, f_type
+            )
+        })?;
+        if fstype != claimed {
+            eprintln!(
+                "fs context from {} is {}, not {} as its sender claimed",
+                socket, fstype, claimed
+            );
+        }
+        config.fstype = Some(fstype.to_string());
+        mnt_fd
+    } else {
+        match &config.fstype {
+            Some(fstype) => {
+                let (ctx, set) = configure_context(fstype, &config)?;
+                let _closing = cleanup.close("fs context", ctx.as_fd());
+                applied = set;
+                mount_context(&ctx, fstype, &config, &mut attrs)?
+            }
+            None if config.clone_from => {
+                let (source, _) = mounted_at(&config, &config.source)?;
+                if config.validate {
+                    check_not_same_dir(&source, target)
+                        .and_then(|()| check_not_nested(&source, target))?;
+                }
+                mount::clone_source(&source, config.recursive, log()).map_err(|e| {
+                    let note = capabilities_note(&config, e.errno());
+                    let msg = format!("clone mount at {} failed: {}", config.source, e.errno());
+                    Failure::from(msg + &note).with_errno(e.errno())
+                })?
+            }
+            None => {
+                // Ensure source exists and is a directory
+                let source = Path::new(&config.source);
+                if !source.exists() || !(source.is_dir() || file_target) {
+                    return Err(format!(
+                        "source does not exist or is not a directory: {}",
+                        config.source
+                    )
+                    .into());
+                }
+                if config.validate {
+                    check_not_same_dir(source, target)
+                        .and_then(|()| check_not_nested(source, target))?;
+                }
+                mount::clone_source(source, config.recursive, log())
+                    .map_err(|e| mount_failure(&config, e))?
+            }
         }
     };
-    // Optionally setns into mount namespace
-    // Mount namespace switching using nix::setns
-    if !args.mount_namespace.is_empty() {
-        let ns_file = match File::open(&args.mount_namespace) {
+    let _closing_mnt = cleanup.close("mount fd", &mnt_fd);
+    // Idmapping only works on a mount that is not attached yet
+    if let Some(userns) = &config.userns {
+        let ns = match File::open(userns) {
             Ok(f) => f,
             Err(e) => {
-                eprintln!(
-                    "open mount namespace {} failed: {}",
-                    args.mount_namespace, e
+                return Err(format!("open user namespace {} failed: {}", userns, e).into());
+            }
+        };
+        // A fresh filesystem is a single mount; a bind clone may be a tree
+        let recursive = config.fstype.is_none() && config.recursive;
+        log().step(format_args!("mount_setattr idmap with {}", userns));
+        if let Err(e) = sys::set_idmap(mnt_fd.as_fd(), ns.as_fd(), recursive) {
+            let note = capabilities_note(&config, e);
+            let msg = format!("idmapping the mount with {} failed: {}", userns, e) + &note;
+            return Err(Failure::from(msg).with_errno(e));
+        }
+    }
+    let orig_ns = NamespaceGuard::new(open_namespace(
+        "original mount",
+        &config.proc_thread_self("ns/mnt").to_string_lossy(),
+    )?);
+    let caller_ns = if args.audit_namespaces {
+        match caller_namespaces(orig_ns.original(), &config.proc_thread_self("ns/user")) {
+            Ok(ns) => Some(ns),
+            Err(e) => {
+                return Err(format!("stat caller namespaces failed: {}", e).into());
+            }
+        }
+    } else {
+        None
+    };
+    if !joined_user_ns {
+        enter_mount_namespace(&config, mnt_ns.as_ref())?;
+    }
+    let audit = match caller_ns {
+        Some((caller_mnt, caller_user)) => match ns_inode(config.proc_thread_self("ns/mnt")) {
+            Ok(target_mnt) => Some(Audit {
+                caller_mnt,
+                caller_user,
+                target_mnt,
+            }),
+            Err(e) => {
+                return Err(format!("stat target mount namespace failed: {}", e).into());
+            }
+        },
+        None => None,
+    };
+    if let Some(audit) = &audit {
+        eprintln!("{}", audit.line());
+    }
+
+    // Check who owns the target before anything changes it
+    if let Some(uid) = config.require_owner {
+        check_owner(target, uid)?;
+    }
+
+    // Create the target directory before move_mount, now in the namespace
+    // it is attached in
+    if let Err(e) = create_target(&config, file_target) {
+        return Err(format!("failed to create target {}: {}", config.target, e).into());
+    }
+
+    // Inspect the mounts of the namespace the target is attached in, before
+    // touching the target, which may be the root of a mount --force-create
+    // is about to remove
+    let resolved = match std::fs::canonicalize(target) {
+        Ok(p) => p,
+        Err(e) => {
+            return Err(format!("resolve target {} failed: {}", config.target, e).into());
+        }
+    };
+    let mut mounts = mountinfo::read(&config.proc_thread_self("mountinfo"))?;
+    let existing: Vec<(String, u32)> = mountinfo::mounts_at(&mounts, &resolved)
+        .iter()
+        .map(|m| (m.fstype.clone(), m.mount_id))
+        .collect();
+    if let Some((fstype, id)) = existing.last() {
+        if config.force_create {
+            if args.confirm {
+                let what = format!(
+                    "unmount the {} mount (id {}) at {} to replace it",
+                    fstype, id, config.target
                 );
-                process::exit(1);
+                confirm(&what, args.yes)?;
+            }
+            // Topmost first, until nothing is left at the target
+            for (fstype, id) in existing.iter().rev() {
+                log().step(format_args!(
+                    "unmounting {} mount (id {}) at {}",
+                    fstype, id, config.target
+                ));
+                if let Err(e) = unmount(target, UnmountFlags::empty()) {
+                    return Err(format!(
+                        "unmounting the {} mount (id {}) at {} failed: {}",
+                        fstype, id, config.target, e
+                    )
+                    .into());
+                }
+            }
+            mounts = mountinfo::read(&config.proc_thread_self("mountinfo"))?;
+        } else if config.warn_overmount && !config.strict {
+            eprintln!(
+                "{} already has a {} mount (id {}) at it, the new mount will stack on top",
+                config.target, fstype, id
+            );
+        } else if config.warn_overmount {
+            return Err(format!(
+                "{} already has a {} mount (id {}) at it, the new mount would stack on top",
+                config.target, fstype, id
+            )
+            .into());
+        } else {
+            let msg = format!(
+                "{} already has a {} mount (id {}) at it; pass --force-create to replace it or --warn-overmount to stack on top",
+                config.target, fstype, id
+            );
+            return Err(msg.into());
+        }
+    }
+    if config.private_parent {
+        let Some(parent) = mountinfo::containing_mount(&mounts, &resolved) else {
+            return Err(format!("no mount found containing {}", config.target).into());
+        };
+        if let Err(e) = mount_change(&parent.mount_point, MountPropagationFlags::PRIVATE) {
+            return Err(format!("making {} private failed: {}", parent.mount_point, e).into());
+        }
+    }
+
+    if file_target {
+        // Leave the permissions of an existing file alone
+    } else if let Err(e) =
+        std::fs::set_permissions(target, std::fs::Permissions::from_mode(config.mode))
+    {
+        return Err(format!(
+            "failed to set permissions on target directory {}: {}",
+            config.target, e
+        )
+        .into());
+    }
+
+    mount::attach(mnt_fd.as_fd(), target, log()).map_err(|e| mount_failure(&config, e))?;
+    let _unmounting = cleanup.unmount(&config, target);
+    if let Some(propagation) = config.propagation {
+        let mut flags = propagation.flags();
+        flags.set(MountPropagationFlags::REC, config.recursive);
+        log().step(format_args!("setting propagation {:?}", flags));
+        if let Err(e) = mount_change(target, flags) {
+            return Err(format!("setting propagation of {} failed: {}", config.target, e).into());
+        }
+    }
+    if let (Some(dev), Some(socket)) = (&fuse_dev, &config.fuse_socket) {
+        log().step(format_args!("sending /dev/fuse fd to {}", socket));
+        fdpass::send(socket, dev.as_fd(), "fuse")?;
+    }
+    // Identify the namespace the mount landed in before leaving it
+    let landed_ns = if args.report_namespace {
+        match ns_inode(config.proc_thread_self("ns/mnt")) {
+            Ok(ino) => Some(ino),
+            Err(e) => {
+                return Err(format!("stat mount namespace failed: {}", e).into());
+            }
+        }
+    } else {
+        None
+    };
+    // Look the mount up while its mount point still resolves to it
+    let landed_mount = if args.report_mount_id {
+        Some(mount_node(&config, target)?)
+    } else {
+        None
+    };
+    let mut result = MountResult {
+        target: config.target.clone(),
+        fstype: config.fstype.clone().unwrap_or_else(|| "bind".to_string()),
+        source: config.source.clone(),
+        options: applied,
+        attrs: attrs::attr_names(attrs),
+        mount_namespace: landed_ns,
+        ready: None,
+        mount: landed_mount,
+        space: None,
+        audit,
+    };
+    if let Some(timeout) = config.wait_ready {
+        if let Err(e) = wait_ready(target, timeout) {
+            if config.teardown_on_not_ready {
+                match unmount(target, UnmountFlags::DETACH) {
+                    Ok(()) => return Err(format!("{}, unmounted it", e).into()),
+                    Err(ue) => {
+                        return Err(format!("{}, and unmounting it failed: {}", e, ue).into())
+                    }
+                }
+            }
+            // Mounted but not ready: report it without touching the mount
+            // further, since anything that looks inside may block as well.
+            // The poller may still hold our fs struct, in which case
+            // switching namespaces back fails; the guard ignores that.
+            eprintln!("{}, leaving it mounted", e);
+            result.ready = Some(false);
+            print!("{}", result.render(args.output));
+            return Ok(EXIT_NOT_READY);
+        }
+        result.ready = Some(true);
+    }
+    // The target only resolves to the new mount inside the namespace it was
+    // attached in, so verify before switching back.
+    if config.verify_magic {
+        let fstype = config.fstype.as_deref().unwrap_or_default();
+        if fstypes::magic(fstype).is_none() {
+            return Err(format!("no known filesystem magic for fstype {}", fstype).into());
+        }
+        match rustix::fs::statfs(target) {
+            Ok(st) => {
+                if let Err(e) = fstypes::check_magic(fstype, st.f_type as u32) {
+                    let msg = format!("filesystem magic mismatch on {}: {}", config.target, e);
+                    return Err(msg.into());
+                }
+            }
+            Err(e) => {
+                return Err(format!("statfs {} failed: {}", config.target, e).into());
+            }
+        }
+    }
+    // Every extra path gets its own bind of the primary mount; a failure at
+    // one path does not stop the others, but does fail the run.
+    // The run fails with the status of the first failure, 14 if it was the
+    // move_mount.
+    let mut also_failed = None;
+    let mut unmounting_also = Vec::new();
+    for path in &config.also_at {
+        log().step(format_args!("binding {} at {}", config.target, path));
+        let bound = sys::clone_tree(target, true)
+            .map_err(|e| (1, e))
+            .and_then(|fd| {
+                sys::attach(fd.as_fd(), Path::new(path)).map_err(|e| (EXIT_MOVE_MOUNT, e))
+            });
+        match bound {
+            Ok(()) => unmounting_also.push(cleanup.unmount(&config, Path::new(path))),
+            Err((status, e)) => {
+                eprintln!("binding {} at {} failed: {}", config.target, path, e);
+                also_failed.get_or_insert((status, e));
+            }
+        }
+    }
+    if let Some((status, errno)) = also_failed {
+        let msg = "not every --also-at path could be bound".to_string();
+        return Err(Failure::new(status, msg).with_errno(errno));
+    }
+    // The command runs as a child, so it sees the namespace mic is in now
+    if let Some((cmd, cmd_args)) = config.post_mount_exec.split_first() {
+        let mut command = process::Command::new(cmd);
+        command.args(cmd_args);
+        if let Some(dev) = &fuse_dev {
+            // Let the command inherit the connection, for a server to take
+            // over
+            if let Err(e) = fcntl_setfd(dev, FdFlags::empty()) {
+                return Err(format!("clearing close-on-exec on /dev/fuse failed: {}", e).into());
             }
+            command.env("MIC_FUSE_FD", dev.as_raw_fd().to_string());
+        }
+        let failure = match command.status() {
+            Ok(status) if status.success() => None,
+            Ok(status) => Some(format!("post-mount command {} failed: {}", cmd, status)),
+            Err(e) => Some(format!("running post-mount command {} failed: {}", cmd, e)),
         };
-        // CLONE_NEWNS is 0x00020000
-        if let Err(e) = setns(&ns_file, CloneFlags::CLONE_NEWNS) {
-            eprintln!("setns to {} failed: {}", args.mount_namespace, e);
-            process::exit(1);
+        if let Some(msg) = failure {
+            // Undo the extra binds before the mount they were cloned from
+            for path in config.also_at.iter().rev().chain([&config.target]) {
+                match unmount(path.as_str(), UnmountFlags::DETACH) {
+                    Ok(()) => eprintln!("unmounted {}", path),
+                    Err(e) => eprintln!("unmounting {} failed: {}", path, e),
+                }
+            }
+            return Err(msg.into());
+        }
+    }
+    // Flip to read-only only now, so that --post-mount-exec can populate it
+    if config.then_ro {
+        // A recursive bind brings submounts along, which must not stay writable
+        let recursive = config.fstype.is_none() && config.recursive;
+        for path in [&config.target].into_iter().chain(&config.also_at) {
+            make_readonly(Path::new(path), recursive)?;
+        }
+    }
+    let space = if args.report_space {
+        match rustix::fs::statfs(target) {
+            Ok(st) => Some(Space::from_statfs(&st)),
+            Err(e) => {
+                return Err(format!("statfs {} failed: {}", config.target, e).into());
+            }
+        }
+    } else {
+        None
+    };
+    // restore original namespace
+    if config.user_namespace.is_some() {
+        // The joined user namespace has no say over the original mount
+        // namespace; mic exits shortly anyway.
+        orig_ns.release();
+    } else {
+        log().step(format_args!("setns back to original namespace"));
+        if let Err(e) = orig_ns.restore() {
+            let msg = format!("setns back to original namespace failed: {}", e);
+            let errno = Errno::from_raw_os_error(e as i32);
+            return Err(Failure::new(EXIT_NAMESPACE, msg).with_errno(errno));
+        }
+    }
+    result.space = space;
+    print!("{}", result.render(args.output));
+    Ok(0)
+}
+
+/// Runs run on a thread of its own and stops waiting for it after timeout.
+///
+/// The syscalls cannot be interrupted, so a thread stuck in one, e.g. in
+/// fsconfig create on a hung network filesystem, is left behind and dies
+/// with the process once main has reported the timeout. Whatever it was
+/// doing may still complete in the kernel. What it had done before is
+/// undone first, see Cleanup.
+fn run_with_timeout(args: Args, timeout: Duration) -> Result<i32, Failure> {
+    with_timeout(timeout, move |cleanup| {
+        // setns(CLONE_NEWNS) refuses a thread that shares its fs struct
+        unshare(CloneFlags::CLONE_FS)
+            .map_err(|e| {
+                let msg = format!("unshare CLONE_FS failed: {}", e);
+                Failure::new(EXIT_NAMESPACE, msg).with_errno(Errno::from_raw_os_error(e as i32))
+            })
+            .and_then(|()| run(&args, cleanup))
+    })
+}
+
+/// Runs work on a thread of its own with a cleanup stack, and if it has not
+/// finished after timeout, runs the stack and fails.
+fn with_timeout(
+    timeout: Duration,
+    work: impl FnOnce(&Cleanup) -> Result<i32, Failure> + Send + 'static,
+) -> Result<i32, Failure> {
+    let cleanup = Arc::new(Cleanup::default());
+    let worker = cleanup.clone();
+    let (tx, rx) = mpsc::channel();
+    thread::spawn(move || {
+        let _ = tx.send(work(&worker));
+    });
+    match rx.recv_timeout(timeout) {
+        Ok(res) => res,
+        Err(mpsc::RecvTimeoutError::Timeout) => {
+            cleanup.run();
+            Err(format!("timed out after {}", humantime::format_duration(timeout)).into())
+        }
+        Err(mpsc::RecvTimeoutError::Disconnected) => {
+            Err("mount thread panicked".to_string().into())
+        }
+    }
+}
+
+type Undo = Box<dyn FnOnce() -> Result<(), String> + Send>;
+
+/// What a mount abandoned by --timeout has to have undone: the fds it has
+/// open and the mounts it has attached. Each step is pushed once taken and
+/// dropped from the stack again with the guard push returns, when the
+/// worker is done with it; only steps still on the stack when the timeout
+/// fires are undone, newest first.
+#[derive(Default)]
+struct Cleanup {
+    steps: Mutex<Vec<(u64, String, Undo)>>,
+    next_id: AtomicU64,
+}
+
+impl Cleanup {
+    fn push(
+        &self,
+        what: String,
+        undo: impl FnOnce() -> Result<(), String> + Send + 'static,
+    ) -> CleanupGuard<'_> {
+        let id = self.next_id.fetch_add(1, Ordering::Relaxed);
+        self.lock().push((id, what, Box::new(undo)));
+        CleanupGuard { cleanup: self, id }
+    }
+
+    /// Closes fd on timeout. The worker still owns it, but main exits right
+    /// after the stack has run, so it is never closed a second time.
+    fn close(&self, what: &str, fd: impl AsFd) -> CleanupGuard<'_> {
+        let raw = fd.as_fd().as_raw_fd();
+        self.push(format!("close {}", what), move || {
+            // SAFETY: the fd is not used again, see above
+            unsafe { rustix::io::close(raw) };
+            Ok(())
+        })
+    }
+
+    /// Detaches the mount at target on timeout, in the mount namespace the
+    /// calling thread is in now.
+    fn unmount(&self, config: &Config, target: &Path) -> CleanupGuard<'_> {
+        // thread-self, as the worker may have changed namespaces on its own
+        let ns = File::open(config.proc_thread_self("ns/mnt")).ok();
+        // setns moves to the namespace's root directory
+        let target = std::fs::canonicalize(target).unwrap_or_else(|_| target.to_path_buf());
+        self.push(format!("unmount {}", target.display()), move || {
+            if let Some(ns) = ns {
+                unshare(CloneFlags::CLONE_FS)
+                    .and_then(|()| setns(ns, CloneFlags::CLONE_NEWNS))
+                    .map_err(|e| format!("setns failed: {}", e))?;
+            }
+            unmount(&target, UnmountFlags::DETACH).map_err(|e| e.to_string())
+        })
+    }
+
+    /// Undoes every step still on the stack, newest first, reporting but
+    /// not stopping at failures.
+    fn run(&self) {
+        let steps = std::mem::take(&mut *self.lock());
+        for (_, what, undo) in steps.into_iter().rev() {
+            log().step(format_args!("cleanup: {}", what));
+            if let Err(e) = undo() {
+                eprintln!("cleanup: {} failed: {}", what, e);
+            }
         }
     }
 
-    // Create the target directory with permission 755 before move_mount
-    if let Err(e) = std::fs::create_dir_all(target) {
-        eprintln!("failed to create target directory {}: {}", args.target, e);
-        process::exit(1);
+    fn lock(&self) -> std::sync::MutexGuard<'_, Vec<(u64, String, Undo)>> {
+        // A step that panicked leaves the stack itself intact
+        self.steps.lock().unwrap_or_else(|e| e.into_inner())
     }
+}
+
+/// Takes its step off the cleanup stack when dropped.
+struct CleanupGuard<'a> {
+    cleanup: &'a Cleanup,
+    id: u64,
+}
+
+impl Drop for CleanupGuard<'_> {
+    fn drop(&mut self) {
+        self.cleanup.lock().retain(|(id, _, _)| *id != self.id);
+    }
+}
+
+/// Opens an fs context for fstype and sets the source and options from
+/// config on it. Returns the context and the options that were set.
+fn configure_context(fstype: &str, config: &Config) -> Result<(FsContext, Vec<String>), Failure> {
+    check_options(fstype, config)?;
+    let opts = MountOptions {
+        options: applicable_options(config)?.into_iter().cloned().collect(),
+        ..mount_options(config)
+    };
+    let (ctx, applied) =
+        mount::configure(fstype, &opts, log()).map_err(|e| mount_failure(config, e))?;
+    Ok((ctx, report_rejected(fstype, applied)))
+}
+
+/// Checks the options in config against what mic knows about fstype before
+/// any of them is passed to the kernel, failing on the first problem.
+fn check_options(fstype: &str, config: &Config) -> Result<(), String> {
+    for opt in &config.options {
+        if config.validate {
+            opt.check_chars()
+                .and_then(|()| fstypes::check_known(fstype, opt))?;
+        }
+        fstypes::check_option(fstype, opt)?;
+    }
+    Ok(())
+}
+
+/// Returns what mount::mount needs to know about config, without any
+/// options; those are filtered first with applicable_options.
+fn mount_options(config: &Config) -> MountOptions {
+    MountOptions {
+        target: PathBuf::from(&config.target),
+        fstype: config.fstype.clone(),
+        source: config.source.clone(),
+        mount_ns: None,
+        options: Vec::new(),
+        attrs: config.attrs,
+        proc_path: Some(PathBuf::from(&config.proc_path)),
+        source_last: config.source_last,
+        source_fd: config.source_fd,
+        continue_on_option_error: config.continue_on_option_error,
+        ignore_option_errors: config.ignore_option_errors,
+        relax_attrs: config.relax_attrs,
+        recursive: config.recursive,
+    }
+}
 
-    if let Err(e) = std::fs::set_permissions(target, std::fs::Permissions::from_mode(0o755)) {
+/// Lists the options --ignore-option-errors let through on stderr and
+/// returns the ones that were set.
+fn report_rejected(fstype: &str, applied: mount::Applied) -> Vec<String> {
+    if !applied.rejected.is_empty() {
         eprintln!(
-            "failed to set permissions on target directory {}: {}",
-            args.target, e
+            "{} option(s) rejected by {}:",
+            applied.rejected.len(),
+            fstype
         );
-        process::exit(1);
+        for err in &applied.rejected {
+            eprintln!("  {}", err);
+        }
+    }
+    applied.options
+}
+
+/// Returns the failure mic exits with for a failed step of the mount, with
+/// the status for the step and, after an EPERM, the capabilities note.
+fn mount_failure(config: &Config, err: MountError) -> Failure {
+    let status = match err {
+        MountError::Fsopen { .. } => EXIT_FSOPEN,
+        MountError::Fsconfig { .. } | MountError::Rejected { .. } => EXIT_FSCONFIG,
+        MountError::Create { .. } => EXIT_CREATE,
+        MountError::Fsmount { .. } => EXIT_FSMOUNT,
+        MountError::MoveMount { .. } => EXIT_MOVE_MOUNT,
+        MountError::Namespace { .. } => EXIT_NAMESPACE,
+        MountError::OpenDevice { .. } | MountError::OpenTree { .. } => 1,
+    };
+    let note = capabilities_note(config, err.errno());
+    Failure::new(status, err.to_string() + &note).with_errno(err.errno())
+}
+
+/// Opens a new /dev/fuse connection for --fuse and puts its fd number in
+/// front of options, since fuse takes the fd parameter as a string.
+fn open_fuse(options: &mut Vec<FsOption>) -> Result<OwnedFd, String> {
+    let dev = rustix::fs::open("/dev/fuse", OFlags::RDWR | OFlags::CLOEXEC, Mode::empty())
+        .map_err(|e| format!("open /dev/fuse failed: {}", e))?;
+    log().step(format_args!(
+        "open /dev/fuse returned fd {}",
+        dev.as_raw_fd()
+    ));
+    options.insert(0, fuse_fd_option(dev.as_raw_fd().to_string()));
+    Ok(dev)
+}
+
+/// Returns the fd option fuse is given the connection with.
+fn fuse_fd_option(fd: String) -> FsOption {
+    FsOption {
+        key: "fd".to_string(),
+        value: Some(fd),
+        min_kernel: None,
+        in_namespace: None,
+        kind: ValueKind::String,
     }
+}
 
-    if let Err(e) = move_mount(
-        source_fd.as_fd(),
-        "",
-        rustix::fs::CWD,
-        target,
-        MoveMountFlags::MOVE_MOUNT_F_EMPTY_PATH,
-    ) {
-        eprintln!("move_mount failed: {}", e);
-        process::exit(1);
+/// Creates the filesystem configured in ctx and returns a detached mount of
+/// it. With --relax-attrs, an attribute the filesystem
+/// rejects is removed from attrs.
+fn mount_context(
+    ctx: &FsContext,
+    fstype: &str,
+    config: &Config,
+    attrs: &mut MountAttrFlags,
+) -> Result<OwnedFd, Failure> {
+    let opts = MountOptions {
+        attrs: *attrs,
+        ..mount_options(config)
+    };
+    let (fd, dropped) =
+        mount::create(ctx, fstype, &opts, log()).map_err(|e| mount_failure(config, e))?;
+    if let Some((name, flag)) = dropped {
+        *attrs -= flag;
+        eprintln!(
+            "{} does not support mount attribute {}, mounting without it",
+            fstype, name
+        );
     }
-    // restore original namespace
-    if let Err(e) = setns(&orig_ns, CloneFlags::CLONE_NEWNS) {
-        eprintln!("setns back to original namespace failed: {}", e);
-        process::exit(1);
+    Ok(fd)
+}
+
+/// Applies the options in config to the filesystem mounted at the target,
+/// inside --mount-namespace if given, and returns the ones that were set.
+fn reconfigure_target(config: &Config) -> Result<Option<Vec<String>>, Failure> {
+    if !config.mount_namespace.is_empty() {
+        enter_namespace(&config.mount_namespace)?;
+    }
+    let (resolved, mount) = mounted_at(config, &config.target)?;
+    let fstype = mount.fstype.clone();
+    check_options(&fstype, config)?;
+    let wanted = applicable_options(config)?;
+    let changed = changed_options(&wanted, &mount);
+    for opt in wanted
+        .iter()
+        .filter(|opt| !changed.iter().any(|c| std::ptr::eq(*c, **opt)))
+    {
+        log().step(format_args!("{} is set already, skipping it", opt));
+    }
+    if changed.is_empty() {
+        return Ok(None);
+    }
+    let ctx = match FsContext::pick(&resolved) {
+        Ok(ctx) => {
+            log().step(format_args!(
+                "fspick {} returned fd {}",
+                resolved.display(),
+                ctx.as_fd().as_raw_fd()
+            ));
+            ctx
+        }
+        Err(e) => {
+            return Err(format!("fspick {} failed: {}", config.target, e).into());
+        }
+    };
+    let opts = MountOptions {
+        options: changed.into_iter().cloned().collect(),
+        ..mount_options(config)
+    };
+    let applied =
+        mount::set_options(&ctx, &fstype, &opts, log()).map_err(|e| mount_failure(config, e))?;
+    let applied = report_rejected(&fstype, applied);
+    log().step(format_args!("fsconfig reconfigure"));
+    if let Err(e) = ctx.reconfigure() {
+        return Err(format!(
+            "fsconfig reconfigure {} failed: {}",
+            config.target,
+            ctx.describe(e)
+        )
+        .into());
+    }
+    Ok(Some(applied))
+}
+
+/// Returns the options in wanted that the superblock options of mount do
+/// not show with the same value already. Values are compared as written,
+/// so one the kernel shows in another form, e.g. size=1M as size=1024k,
+/// counts as changed and is set again.
+fn changed_options<'a>(wanted: &[&'a FsOption], mount: &MountInfo) -> Vec<&'a FsOption> {
+    let current = mount.super_option_pairs();
+    wanted
+        .iter()
+        .filter(|opt| !current.contains(&(opt.key.as_str(), opt.value.as_deref())))
+        .copied()
+        .collect()
+}
+
+/// Returns the resolved path and the topmost mount on it, failing if
+/// nothing is mounted exactly at path.
+fn mounted_at(config: &Config, path: &str) -> Result<(PathBuf, MountInfo), String> {
+    let mounts = mountinfo::read(&config.proc_thread_self("mountinfo"))?;
+    let resolved =
+        std::fs::canonicalize(path).map_err(|e| format!("resolve {} failed: {}", path, e))?;
+    let Some(top) = mountinfo::mounts_at(&mounts, &resolved).pop() else {
+        return Err(format!("{} is not a mountpoint", path));
+    };
+    Ok((resolved, top.clone()))
+}
+
+/// Returns the IDs and propagation of the topmost mount at target, from the
+/// mountinfo of the current namespace.
+fn mount_node(config: &Config, target: &Path) -> Result<MountNode, String> {
+    let mounts = mountinfo::read(&config.proc_thread_self("mountinfo"))?;
+    let resolved = std::fs::canonicalize(target)
+        .map_err(|e| format!("resolve target {} failed: {}", config.target, e))?;
+    let Some(top) = mountinfo::mounts_at(&mounts, &resolved).pop() else {
+        return Err(format!("{} is not a mountpoint", config.target));
+    };
+    Ok(MountNode {
+        id: top.mount_id,
+        parent_id: top.parent_id,
+        propagation: top.propagation.clone(),
+    })
+}
+
+/// Returns the options in config whose conditions hold for this mount, noting
+/// each skipped one on stderr. Fails if the kernel version is needed and
+/// cannot be determined.
+fn applicable_options(config: &Config) -> Result<Vec<&FsOption>, String> {
+    // Only look up the running kernel when an option is conditional on it
+    let kernel = if config.options.iter().any(|opt| opt.min_kernel.is_some()) {
+        Some(KernelVersion::running()?)
+    } else {
+        None
+    };
+    let namespaced = !config.mount_namespace.is_empty() || config.new_namespace;
+    let mut applicable = Vec::new();
+    for opt in &config.options {
+        if !opt.applies_in(namespaced) {
+            let when = if namespaced {
+                "in the current mount namespace"
+            } else {
+                "in another mount namespace"
+            };
+            eprintln!("skipping option {}: only applies {}", opt, when);
+            continue;
+        }
+        if let (Some(min), Some(kernel)) = (opt.min_kernel, kernel) {
+            if !opt.applies_to(kernel) {
+                eprintln!(
+                    "skipping option {}: requires kernel {} or newer, running {}",
+                    opt, min, kernel
+                );
+                continue;
+            }
+        }
+        applicable.push(opt);
+    }
+    Ok(applicable)
+}
+
+/// Lists the syscalls a mount with config would make, in order, for
+/// --dry-run. Steps that depend on what is found at run time, such as
+/// creating a missing target, are marked as conditional.
+fn plan(config: &Config) -> Result<Vec<String>, String> {
+    let mut steps = Vec::new();
+    let attrs = attrs::attr_names(config.attrs).join("|");
+    let attrs = if attrs.is_empty() {
+        "0".to_string()
+    } else {
+        attrs
+    };
+    let fsmount = format!("fsmount(fs_fd, FSMOUNT_CLOEXEC, {})", attrs);
+    let mut config = config.clone();
+    if config.fuse {
+        steps.push("open(\"/dev/fuse\", O_RDWR|O_CLOEXEC) -> fuse_fd".to_string());
+        config
+            .options
+            .insert(0, fuse_fd_option("<fuse_fd>".to_string()));
+    }
+    let config = &config;
+    if let Some(path) = &config.user_namespace {
+        steps.push(format!("setns(<open {}>, CLONE_NEWUSER)", path));
+    }
+    if let Some(path) = &config.net_namespace {
+        steps.push(format!("setns(<open {}>, CLONE_NEWNET)", path));
+    }
+    let mut enter_mnt = Vec::new();
+    if !config.mount_namespace.is_empty() {
+        enter_mnt.push(format!(
+            "setns(<open {}>, CLONE_NEWNS)",
+            config.mount_namespace
+        ));
+    } else if config.new_namespace {
+        enter_mnt.push("unshare(CLONE_NEWNS)".to_string());
+        if config.isolate {
+            enter_mnt.push("mount(NULL, \"/\", NULL, MS_REC|MS_PRIVATE, NULL)".to_string());
+        }
+    }
+    // With a user namespace, the mount namespace is entered before fsopen
+    if config.user_namespace.is_some() {
+        steps.append(&mut enter_mnt);
+    }
+    if let Some(socket) = &config.recv_context {
+        steps.push(format!(
+            "recvmsg(<connection on {}>, SCM_RIGHTS) -> fs_fd",
+            socket
+        ));
+        steps.push("fsconfig(fs_fd, FSCONFIG_CMD_CREATE)".to_string());
+        steps.push(fsmount);
+    } else if let Some(fstype) = &config.fstype {
+        steps.push(format!("fsopen({:?}, FSOPEN_CLOEXEC) -> fs_fd", fstype));
+        let source = FsOption {
+            key: "source".to_string(),
+            value: Some(config.source.clone()),
+            min_kernel: None,
+            in_namespace: None,
+            kind: if config.source_fd {
+                ValueKind::Fd
+            } else {
+                ValueKind::String
+            },
+        };
+        let opts = MountOptions {
+            options: applicable_options(config)?.into_iter().cloned().collect(),
+            ..mount_options(config)
+        };
+        for setting in mount::settings(&opts) {
+            let opt = match setting {
+                Setting::Source => &source,
+                Setting::Option(opt) => opt,
+            };
+            steps.push(format!("fsconfig(fs_fd, {})", opt.plan()));
+        }
+        steps.push("fsconfig(fs_fd, FSCONFIG_CMD_CREATE)".to_string());
+        steps.push(fsmount);
+    } else {
+        let recursive = if config.recursive {
+            "|AT_RECURSIVE"
+        } else {
+            ""
+        };
+        steps.push(format!(
+            "open_tree(AT_FDCWD, {:?}, OPEN_TREE_CLONE|OPEN_TREE_CLOEXEC{})",
+            config.source, recursive
+        ));
+    }
+    if let Some(userns) = &config.userns {
+        let recursive = if config.fstype.is_none() && config.recursive {
+            "|AT_RECURSIVE"
+        } else {
+            ""
+        };
+        steps.push(format!(
+            "mount_setattr(mnt_fd, \"\", AT_EMPTY_PATH{}, {{attr_set: MOUNT_ATTR_IDMAP, userns_fd: <open {}>}})",
+            recursive, userns
+        ));
+    }
+    if config.user_namespace.is_none() {
+        steps.append(&mut enter_mnt);
+    }
+    steps.push(format!(
+        "mkdir({:?}, {:04o}) if missing",
+        config.target, config.mode
+    ));
+    if config.force_create {
+        steps.push(format!(
+            "umount2({:?}, 0) for each mount already at it",
+            config.target
+        ));
+    }
+    if config.private_parent {
+        steps.push(format!(
+            "mount(NULL, <mount containing {}>, NULL, MS_PRIVATE, NULL)",
+            config.target
+        ));
+    }
+    steps.push(format!(
+        "move_mount(mnt_fd, \"\", AT_FDCWD, {:?}, MOVE_MOUNT_F_EMPTY_PATH)",
+        config.target
+    ));
+    if let Some(propagation) = config.propagation {
+        let name = match propagation {
+            Propagation::Private => "MS_PRIVATE",
+            Propagation::Shared => "MS_SHARED",
+            Propagation::Slave => "MS_SLAVE",
+            Propagation::Unbindable => "MS_UNBINDABLE",
+        };
+        let rec = if config.recursive { "MS_REC|" } else { "" };
+        steps.push(format!(
+            "mount(NULL, {:?}, NULL, {}{}, NULL)",
+            config.target, rec, name
+        ));
+    }
+    if let Some(socket) = &config.fuse_socket {
+        steps.push(format!(
+            "sendmsg(<connection to {}>, SCM_RIGHTS fuse_fd)",
+            socket
+        ));
+    }
+    for path in &config.also_at {
+        steps.push(format!(
+            "open_tree(AT_FDCWD, {:?}, OPEN_TREE_CLONE|OPEN_TREE_CLOEXEC|AT_RECURSIVE)",
+            config.target
+        ));
+        steps.push(format!(
+            "move_mount(clone_fd, \"\", AT_FDCWD, {:?}, MOVE_MOUNT_F_EMPTY_PATH)",
+            path
+        ));
+    }
+    if let Some((cmd, _)) = config.post_mount_exec.split_first() {
+        steps.push(format!("execve({:?}, ...) in a child", cmd));
+    }
+    if config.then_ro {
+        let recursive = if config.fstype.is_none() && config.recursive {
+            "AT_RECURSIVE"
+        } else {
+            "0"
+        };
+        for path in [&config.target].into_iter().chain(&config.also_at) {
+            steps.push(format!(
+                "mount_setattr(AT_FDCWD, {:?}, {}, {{attr_set: MOUNT_ATTR_RDONLY}})",
+                path, recursive
+            ));
+        }
+    }
+    if (!config.mount_namespace.is_empty() || config.new_namespace)
+        && config.user_namespace.is_none()
+    {
+        steps.push("setns(<original mount namespace>, CLONE_NEWNS)".to_string());
+    }
+    Ok(steps)
+}
+
+/// Fails unless mic has CAP_SYS_ADMIN in its effective set.
+fn check_sys_admin(config: &Config) -> Result<(), String> {
+    let mask = caps::effective(&config.proc_thread_self("status"))
+        .map_err(|e| format!("{}; pass --skip-cap-check to go ahead without checking", e))?;
+    if mask & (1 << caps::CAP_SYS_ADMIN) == 0 {
+        return Err("mic requires CAP_SYS_ADMIN (try running as root)".to_string());
+    }
+    Ok(())
+}
+
+/// After an EPERM, returns the effective capabilities of mic to append to
+/// the error, to tell a missing CAP_SYS_ADMIN apart from a denial by an LSM
+/// or seccomp. Returns an empty string for other errors.
+fn capabilities_note(config: &Config, err: Errno) -> String {
+    if err != Errno::PERM {
+        return String::new();
+    }
+    match caps::effective(&config.proc_thread_self("status")) {
+        Ok(mask) => {
+            let names = caps::names(mask);
+            if names.is_empty() {
+                "; effective capabilities: none".to_string()
+            } else {
+                format!("; effective capabilities: {}", names.join(", "))
+            }
+        }
+        Err(e) => format!("; {}", e),
+    }
+}
+
+/// Returns the log set up for --verbose, which is quiet without it.
+fn log() -> &'static Log {
+    LOG.get_or_init(Log::quiet)
+}
+
+/// Prints the failure's message to stderr, as a JSON object with --output
+/// json, and exits with its status.
+fn fail(failure: Failure) -> ! {
+    match ERROR_FORMAT.get() {
+        Some(OutputFormat::Json) => {
+            eprintln!("{}", output::error_json(&failure.msg, failure.errno))
+        }
+        _ => eprintln!("{}", failure.msg),
+    }
+    process::exit(failure.status);
+}
+
+/// Mounts the entries of the --config file at path in order. Every entry is
+/// parsed and checked before the first is mounted, and each is then mounted
+/// by running mic with its arguments, so a failing entry cannot leave this
+/// process in another namespace. With rollback, a failure unmounts what the
+/// earlier entries mounted, newest first. Once all are mounted, prints how
+/// many and how long they took.
+fn run_batch(path: &str, rollback: bool, format: OutputFormat) -> Result<(), String> {
+    let text = std::fs::read_to_string(path).map_err(|e| format!("read {} failed: {}", path, e))?;
+    let entries = batch::parse(&text).map_err(|e| format!("{}: {}", path, e))?;
+    let mut parsed = Vec::new();
+    for entry in &entries {
+        let at = format!("{}:{}", path, entry.line);
+        let args = match Args::try_parse_from(
+            std::iter::once("mic").chain(entry.args.iter().map(String::as_str)),
+        ) {
+            Ok(args) => args,
+            Err(e) => {
+                let msg = e.to_string();
+                let first = msg.lines().next().unwrap_or_default();
+                return Err(format!("{}: {}", at, first.trim_start_matches("error: ")));
+            }
+        };
+        if args.config_file.is_some() {
+            return Err(format!("{}: --config cannot be nested", at));
+        }
+        match args.config() {
+            Ok(config) => parsed.push((args, config)),
+            Err(e) => return Err(format!("{}: {}", at, e)),
+        }
+    }
+    let mut cache = batch::ProcCache::new(|path: &Path| {
+        std::fs::read_to_string(path).map_err(|e| format!("read {} failed: {}", path.display(), e))
+    });
+    for (entry, (args, config)) in entries.iter().zip(&parsed) {
+        let at = format!("{}:{}", path, entry.line);
+        if args.mounts() {
+            check_entry(&mut cache, config, &at).map_err(|e| format!("{}: {}", at, e))?;
+        }
+    }
+    let exe = std::env::current_exe()
+        .map_err(|e| format!("locating the mic executable failed: {}", e))?;
+    let items: Vec<_> = entries.iter().zip(&parsed).collect();
+    let durations = batch::mount_all(
+        &items,
+        rollback,
+        |(_, (args, _))| args.mounts(),
+        |(entry, (args, config))| {
+            let at = format!("{}:{}", path, entry.line);
+            let started = Instant::now();
+            match process::Command::new(&exe).args(&entry.args).status() {
+                Ok(status) if status.success() => {
+                    let took = started.elapsed();
+                    // The mount table has changed
+                    cache.invalidate_mountinfo();
+                    check_mounted(&mut cache, args, config)
+                        .map(|()| took)
+                        .map_err(|e| format!("{}: {}", at, e))
+                }
+                Ok(status) => Err(format!("{}: mount failed: {}", at, status)),
+                Err(e) => Err(format!("{}: running mic failed: {}", at, e)),
+            }
+        },
+        |(_, (_, config))| roll_back(&exe, config),
+    )?;
+    let summary = BatchSummary {
+        mounted: durations.len(),
+        latency: batch::latency(&durations),
+    };
+    print!("{}", summary.render(format));
+    Ok(())
+}
+
+/// Reports whether config mounts in the namespace mic runs in, whose mount
+/// table a --config run can see.
+fn in_current_namespace(config: &Config) -> bool {
+    config.mount_namespace.is_empty() && !config.new_namespace && config.user_namespace.is_none()
+}
+
+/// Checks a --config entry, from the line at, before anything is mounted:
+/// warns if its fstype is not one the kernel has registered, and fails if
+/// its target is taken already, which the entry itself would only find out
+/// once the entries before it are mounted.
+fn check_entry(
+    cache: &mut batch::ProcCache<impl FnMut(&Path) -> Result<String, String>>,
+    config: &Config,
+    at: &str,
+) -> Result<(), String> {
+    if let Some(fstype) = &config.fstype {
+        let path = Path::new(&config.proc_path).join("filesystems");
+        if !cache.filesystems(&path)?.contains(fstype) {
+            eprintln!(
+                "{}: {} is not in {}, mounting it relies on the kernel loading a module for it",
+                at,
+                fstype,
+                path.display()
+            );
+        }
+    }
+    if !in_current_namespace(config) || config.force_create || config.warn_overmount {
+        return Ok(());
+    }
+    // A missing target is created by the entry, so it is free
+    let Ok(resolved) = std::fs::canonicalize(&config.target) else {
+        return Ok(());
+    };
+    let mounts = cache.mountinfo(&config.proc_thread_self("mountinfo"))?;
+    if let Some(m) = mountinfo::mounts_at(mounts, &resolved).last() {
+        return Err(format!(
+            "{} already has a {} mount (id {}) at it; pass --force-create to replace it or --warn-overmount to stack on top",
+            config.target, m.fstype, m.mount_id
+        ));
+    }
+    Ok(())
+}
+
+/// Checks that an entry that reported success left a mount at its target,
+/// where mic can see it.
+fn check_mounted(
+    cache: &mut batch::ProcCache<impl FnMut(&Path) -> Result<String, String>>,
+    args: &Args,
+    config: &Config,
+) -> Result<(), String> {
+    if !args.mounts() || !in_current_namespace(config) {
+        return Ok(());
+    }
+    let resolved = std::fs::canonicalize(&config.target)
+        .map_err(|e| format!("resolve target {} failed: {}", config.target, e))?;
+    let mounts = cache.mountinfo(&config.proc_thread_self("mountinfo"))?;
+    if mountinfo::mounts_at(mounts, &resolved).is_empty() {
+        return Err(format!(
+            "mic succeeded but nothing is mounted at {}",
+            config.target
+        ));
+    }
+    Ok(())
+}
+
+/// Unmounts what a --config entry mounted, reporting but not stopping at
+/// failures, since the rest should still be rolled back.
+fn roll_back(exe: &Path, config: &Config) {
+    if config.new_namespace {
+        eprintln!(
+            "not rolling back {}: its new namespace is gone",
+            config.target
+        );
+        return;
+    }
+    for path in config.also_at.iter().rev().chain([&config.target]) {
+        let mut cmd = process::Command::new(exe);
+        cmd.args(["--unmount", "--target", path.as_str()]);
+        cmd.args(["--proc-path", config.proc_path.as_str()]);
+        if !config.mount_namespace.is_empty() {
+            cmd.args(["--mount-namespace", config.mount_namespace.as_str()]);
+        }
+        match cmd.status() {
+            Ok(status) if status.success() => eprintln!("rolled back {}", path),
+            Ok(status) => eprintln!("rolling back {} failed: {}", path, status),
+            Err(e) => eprintln!("rolling back {} failed: {}", path, e),
+        }
+    }
+}
+
+/// Parses --mode as octal permission bits, e.g. 755 or 0700.
+fn parse_mode(s: &str) -> Result<u32, String> {
+    match u32::from_str_radix(s, 8) {
+        Ok(mode) if mode <= 0o7777 => Ok(mode),
+        _ => Err(format!("invalid mode {:?}, expected octal like 755", s)),
+    }
+}
+
+/// Returns the path of the mount namespace of process pid under procfs at
+/// proc_path, failing if there is no such process.
+fn pid_namespace(proc_path: &str, pid: u32) -> Result<String, String> {
+    let dir = Path::new(proc_path).join(pid.to_string());
+    if !dir.exists() {
+        return Err(format!(
+            "no process with PID {} (nothing at {})",
+            pid,
+            dir.display()
+        ));
+    }
+    Ok(dir.join("ns/mnt").to_string_lossy().into_owned())
+}
+
+/// Switches into the namespace the mount is attached in: mnt_ns, opened
+/// from --mount-namespace, or with --new-namespace a fresh one.
+fn enter_mount_namespace(config: &Config, mnt_ns: Option<&File>) -> Result<(), Failure> {
+    // Mount namespace switching using nix::setns
+    if let Some(ns_file) = mnt_ns {
+        // CLONE_NEWNS is 0x00020000
+        log().step(format_args!("setns to {}", config.mount_namespace));
+        if let Err(e) = setns(ns_file, CloneFlags::CLONE_NEWNS) {
+            let errno = Errno::from_raw_os_error(e as i32);
+            let note = capabilities_note(config, errno);
+            let msg = format!("setns to {} failed: {}", config.mount_namespace, e) + &note;
+            return Err(Failure::new(EXIT_NAMESPACE, msg).with_errno(errno));
+        }
+    }
+    // Unshare into a new mount namespace. Namespaces are per thread, so
+    // this only moves the thread doing the mount: with --timeout that is
+    // the worker, which gave up sharing its fs struct with main first, as
+    // unshare(CLONE_NEWNS) requires. The --wait-ready poller is spawned
+    // later, from this thread, and so starts out in the new namespace too.
+    if config.new_namespace {
+        log().step(format_args!("unshare CLONE_NEWNS"));
+        if let Err(e) = unshare(CloneFlags::CLONE_NEWNS) {
+            let errno = Errno::from_raw_os_error(e as i32);
+            let note = capabilities_note(config, errno);
+            let msg = format!("unshare mount namespace failed: {}", e) + &note;
+            return Err(Failure::new(EXIT_NAMESPACE, msg).with_errno(errno));
+        }
+        if config.isolate {
+            if let Err(e) = mount_change(
+                "/",
+                MountPropagationFlags::REC | MountPropagationFlags::PRIVATE,
+            ) {
+                let msg = format!("making / recursively private failed: {}", e);
+                return Err(Failure::new(EXIT_NAMESPACE, msg).with_errno(e));
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Opens the namespace file at path; kind names it in the error.
+fn open_namespace(kind: &str, path: &str) -> Result<File, Failure> {
+    File::open(path).map_err(|e| {
+        let msg = format!("open {} namespace {} failed: {}", kind, path, e);
+        let failure = Failure::new(EXIT_NAMESPACE, msg);
+        match e.raw_os_error() {
+            Some(raw) => failure.with_errno(Errno::from_raw_os_error(raw)),
+            None => failure,
+        }
+    })
+}
+
+/// Switches the calling thread into the mount namespace at path.
+fn enter_namespace(path: &str) -> Result<(), Failure> {
+    let ns = open_namespace("mount", path)?;
+    setns(&ns, CloneFlags::CLONE_NEWNS).map_err(|e| {
+        let msg = format!("setns to {} failed: {}", path, e);
+        Failure::new(EXIT_NAMESPACE, msg).with_errno(Errno::from_raw_os_error(e as i32))
+    })
+}
+
+/// Unmounts the topmost mount at the target, inside --mount-namespace if
+/// given. Fails if nothing is mounted exactly at the target, rather than
+/// leaving it to the kernel's EINVAL or unmounting the mount it resides on.
+fn unmount_target(config: &Config, flags: UnmountFlags) -> Result<(), Failure> {
+    if !config.mount_namespace.is_empty() {
+        enter_namespace(&config.mount_namespace)?;
+    }
+    let (resolved, _) = mounted_at(config, &config.target)?;
+    unmount(&resolved, flags).map_err(|e| {
+        Failure::from(format!("unmount {} failed: {}", config.target, e)).with_errno(e)
+    })
+}
+
+/// Makes the mount at the target read-only with mount_setattr, inside
+/// --mount-namespace if given, recursively unless --no-recursive. Like
+/// unmount_target, fails if nothing is mounted exactly at the target.
+fn remount_readonly(config: &Config) -> Result<(), Failure> {
+    if !config.mount_namespace.is_empty() {
+        enter_namespace(&config.mount_namespace)?;
+    }
+    let (resolved, _) = mounted_at(config, &config.target)?;
+    make_readonly(&resolved, config.recursive)?;
+    Ok(())
+}
+
+/// Calls create until it succeeds, fails with something other than ENOENT
+/// or EEXIST, or has been retried retries times. Those two errors come from
+/// racing with another process that removes or creates a directory on the
+/// path while it is being built, which a later attempt can get past.
+fn retry_mkdir(
+    retries: u32,
+    mut create: impl FnMut() -> std::io::Result<()>,
+) -> std::io::Result<()> {
+    let mut attempt = 0;
+    loop {
+        match create() {
+            Err(e) if attempt < retries && is_mkdir_race(&e) => {
+                attempt += 1;
+                thread::sleep(Duration::from_millis(10));
+            }
+            res => return res,
+        }
+    }
+}
+
+fn is_mkdir_race(e: &std::io::Error) -> bool {
+    matches!(e.raw_os_error(), Some(libc::ENOENT) | Some(libc::EEXIST))
+}
+
+/// Asks on stderr whether to go ahead and what, and reads the answer from
+/// stdin, for --confirm. Without a terminal to ask on, only yes lets it go
+/// ahead.
+fn confirm(what: &str, yes: bool) -> Result<(), String> {
+    let stdin = std::io::stdin();
+    let tty = stdin.is_terminal();
+    confirm_with(what, yes, tty, &mut stdin.lock(), &mut std::io::stderr())
+}
+
+/// The work of confirm, reading the answer from input if tty says it is
+/// interactive.
+fn confirm_with(
+    what: &str,
+    yes: bool,
+    tty: bool,
+    input: &mut impl BufRead,
+    prompt: &mut impl Write,
+) -> Result<(), String> {
+    if yes {
+        return Ok(());
+    }
+    if !tty {
+        return Err(format!(
+            "refusing to {} without a terminal to confirm on; pass --yes to go ahead",
+            what
+        ));
+    }
+    let _ = write!(prompt, "{}? [y/N] ", what);
+    let _ = prompt.flush();
+    let mut answer = String::new();
+    if let Err(e) = input.read_line(&mut answer) {
+        return Err(format!("reading confirmation failed: {}", e));
+    }
+    match answer.trim() {
+        "y" | "Y" | "yes" | "Yes" | "YES" => Ok(()),
+        _ => Err(format!("not confirmed, did not {}", what)),
+    }
+}
+
+/// Fails unless target is owned by uid. A missing target counts as owned by
+/// the effective uid, which is who create_target would create it as.
+fn check_owner(target: &Path, uid: u32) -> Result<(), String> {
+    let owner = match std::fs::metadata(target) {
+        Ok(md) => md.uid(),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => geteuid().as_raw(),
+        Err(e) => return Err(format!("stat target {} failed: {}", target.display(), e)),
+    };
+    if owner != uid {
+        return Err(format!(
+            "target {} is owned by uid {}, expected {}",
+            target.display(),
+            owner,
+            uid
+        ));
+    }
+    Ok(())
+}
+
+/// Creates the target directory with mode --mode, or an empty file with mode
+/// 644 for a single-file bind, unless it already exists. umask is
+/// process-wide, but nothing else runs while --mkdir-umask clears it.
+fn create_target(config: &Config, file_target: bool) -> std::io::Result<()> {
+    let target = Path::new(&config.target);
+    let prev_umask = config.mkdir_umask.then(|| umask(Mode::empty()));
+    let created = retry_mkdir(config.mkdir_retries, || {
+        if file_target {
+            create_file_target(target, config.mode)
+        } else {
+            DirBuilder::new()
+                .recursive(true)
+                .mode(config.mode)
+                .create(target)
+        }
+    });
+    if let Some(prev) = prev_umask {
+        umask(prev);
+    }
+    created
+}
+
+/// Creates target as an empty file with mode 644, and any missing parent
+/// directories with dir_mode, unless it already exists.
+fn create_file_target(target: &Path, dir_mode: u32) -> std::io::Result<()> {
+    if let Some(parent) = target.parent() {
+        DirBuilder::new()
+            .recursive(true)
+            .mode(dir_mode)
+            .create(parent)?;
+    }
+    OpenOptions::new()
+        .write(true)
+        .create(true)
+        .truncate(false)
+        .mode(0o644)
+        .open(target)
+        .map(drop)
+}
+
+/// Returns the inode number identifying the namespace behind a
+/// /proc/<pid>/ns/* file, as shown by readlink on it.
+fn ns_inode(path: impl AsRef<Path>) -> std::io::Result<u64> {
+    let ns = File::open(path)?;
+    Ok(rustix::fs::fstat(&ns)?.st_ino)
+}
+
+/// Returns the inodes of the caller's mount namespace, open as mnt_ns, and
+/// of its user namespace, found at user_ns.
+fn caller_namespaces(mnt_ns: &File, user_ns: &Path) -> std::io::Result<(u64, u64)> {
+    let mnt = rustix::fs::fstat(mnt_ns)?.st_ino;
+    Ok((mnt, ns_inode(user_ns)?))
+}
+
+/// Reports for each option whether fstype accepts it. Every option is set on
+/// its own throwaway fs context so that one rejection cannot affect the rest.
+/// The contexts are never created or mounted, just closed. Returns whether
+/// all options were accepted.
+fn probe_options(fstype: &str, config: &Config) -> bool {
+    let probes = probes(config);
+    let results = probe_each(&probes, || {
+        FsContext::open(fstype).map_err(|e| format!("fsopen {} failed: {}", fstype, e))
+    });
+    let mut all_ok = true;
+    for (opt, res) in probes.iter().zip(results) {
+        match res {
+            Ok(()) => println!("accepted {}", opt),
+            Err(e) => {
+                println!("rejected {}: {}", opt, e);
+                all_ok = false;
+            }
+        }
+    }
+    all_ok
+}
+
+/// Returns what probe_options tries: the source, if any, then the options.
+fn probes(config: &Config) -> Vec<FsOption> {
+    let source = FsOption {
+        key: "source".to_string(),
+        value: Some(config.source.clone()),
+        min_kernel: None,
+        in_namespace: None,
+        kind: ValueKind::String,
+    };
+    (!config.source.is_empty())
+        .then_some(source)
+        .into_iter()
+        .chain(config.options.iter().cloned())
+        .collect()
+}
+
+/// A context options can be tried on. There is deliberately no way to
+/// create it, so dropping it is all it takes to discard everything.
+trait Probe {
+    fn try_option(&self, opt: &FsOption) -> Result<(), String>;
+}
+
+impl Probe for FsContext {
+    fn try_option(&self, opt: &FsOption) -> Result<(), String> {
+        self.set_option(opt).map_err(|e| self.describe(e))
+    }
+}
+
+/// Tries each option on a fresh context from open, which is dropped before
+/// the next one is opened, and returns the outcome for each in order.
+fn probe_each<P: Probe>(
+    options: &[FsOption],
+    mut open: impl FnMut() -> Result<P, String>,
+) -> Vec<Result<(), String>> {
+    options
+        .iter()
+        .map(|opt| open().and_then(|ctx| ctx.try_option(opt)))
+        .collect()
+}
+
+/// Lists the syscalls probe_options makes for --dry-run, marked as the
+/// probe's since unlike the rest of the plan they are really made.
+fn probe_plan(fstype: &str, config: &Config) -> Vec<String> {
+    probes(config)
+        .iter()
+        .flat_map(|opt| {
+            [
+                format!("probe: fsopen({:?}, FSOPEN_CLOEXEC) -> probe_fd", fstype),
+                format!("probe: fsconfig(probe_fd, {})", opt.plan()),
+                "probe: close(probe_fd)".to_string(),
+            ]
+        })
+        .collect()
+}
+
+/// Fails if source and target are the same directory, comparing device and
+/// inode so that symlinked or otherwise differently spelled paths are caught.
+fn check_not_same_dir(source: &Path, target: &Path) -> Result<(), String> {
+    let src = std::fs::metadata(source)
+        .map_err(|e| format!("stat source {} failed: {}", source.display(), e))?;
+    let dst = std::fs::metadata(target)
+        .map_err(|e| format!("stat target {} failed: {}", target.display(), e))?;
+    if (src.dev(), src.ino()) == (dst.dev(), dst.ino()) {
+        return Err(format!(
+            "source {} and target {} are the same directory",
+            source.display(),
+            target.display()
+        ));
+    }
+    Ok(())
+}
+
+/// Fails if target lies inside the source tree, which would bind the source
+/// into its own subtree. Each parent of the resolved target is compared with
+/// source by device and inode, so neither symlinks nor bind mounts of the
+/// source elsewhere hide the nesting.
+fn check_not_nested(source: &Path, target: &Path) -> Result<(), String> {
+    let src = std::fs::metadata(source)
+        .map_err(|e| format!("stat source {} failed: {}", source.display(), e))?;
+    let resolved = target
+        .canonicalize()
+        .map_err(|e| format!("resolve target {} failed: {}", target.display(), e))?;
+    for parent in resolved.ancestors().skip(1) {
+        let Ok(meta) = std::fs::metadata(parent) else {
+            continue;
+        };
+        if (meta.dev(), meta.ino()) == (src.dev(), src.ino()) {
+            return Err(format!(
+                "target {} is inside source {}, which would create a mount loop",
+                target.display(),
+                source.display()
+            ));
+        }
+    }
+    Ok(())
+}
+
+/// Fails if config has more options than --max-options allows.
+fn check_option_count(config: &Config) -> Result<(), String> {
+    match config.max_options {
+        Some(max) if config.options.len() > max => Err(format!(
+            "{} options given, more than the maximum of {}",
+            config.options.len(),
+            max
+        )),
+        _ => Ok(()),
+    }
+}
+
+/// Sets MOUNT_ATTR_RDONLY on the mount at path, and with recursive on the
+/// mounts below it, and reads the mount flags back to confirm it took
+/// effect.
+fn make_readonly(path: &Path, recursive: bool) -> Result<(), String> {
+    log().step(format_args!("mount_setattr ro on {}", path.display()));
+    sys::mount_setattr(
+        path,
+        MountAttrFlags::MOUNT_ATTR_RDONLY,
+        MountAttrFlags::empty(),
+        recursive,
+    )
+    .map_err(|e| format!("making {} read-only failed: {}", path.display(), e))?;
+    let st = rustix::fs::statvfs(path)
+        .map_err(|e| format!("statvfs {} failed: {}", path.display(), e))?;
+    if !st.f_flag.contains(rustix::fs::StatVfsMountFlags::RDONLY) {
+        return Err(format!(
+            "{} is still writable after making it read-only",
+            path.display()
+        ));
+    }
+    Ok(())
+}
+
+/// Polls statfs on target until it succeeds or timeout elapses.
+///
+/// statfs runs on a helper thread, since on a FUSE mount it blocks until the
+/// daemon has answered INIT. The thread is created after any setns and so
+/// resolves target in the same mount namespace. It shares our fs struct,
+/// which makes setns(CLONE_NEWNS) fail, so it is joined before returning;
+/// on timeout it may still be blocked and is left to die with the process.
+fn wait_ready(target: &Path, timeout: Duration) -> Result<(), String> {
+    let path = target.to_path_buf();
+    poll_ready(target, timeout, move || rustix::fs::statfs(&path).map(drop))
+}
+
+/// Calls probe on a helper thread every 50ms until it succeeds, and waits
+/// for that up to timeout. target names the mount in the error.
+fn poll_ready(
+    target: &Path,
+    timeout: Duration,
+    probe: impl Fn() -> rustix::io::Result<()> + Send + 'static,
+) -> Result<(), String> {
+    let (tx, rx) = mpsc::channel();
+    let poller = thread::spawn(move || loop {
+        let res = probe();
+        let done = res.is_ok();
+        if tx.send(res).is_err() || done {
+            return;
+        }
+        thread::sleep(Duration::from_millis(50));
+    });
+    let deadline = Instant::now() + timeout;
+    let mut last_err = None;
+    loop {
+        match rx.recv_timeout(deadline.saturating_duration_since(Instant::now())) {
+            Ok(Ok(())) => {
+                let _ = poller.join();
+                return Ok(());
+            }
+            Ok(Err(e)) => last_err = Some(e),
+            Err(_) => {
+                let timeout = humantime::format_duration(timeout);
+                return Err(match last_err {
+                    Some(e) => format!("{} not ready after {}: {}", target.display(), timeout, e),
+                    None => format!("{} not ready after {}", target.display(), timeout),
+                });
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::cell::RefCell;
+    use std::rc::Rc;
+    use std::sync::atomic::{AtomicU32, Ordering};
+    use std::sync::Arc;
+
+    /// Returns an empty directory for test name under the temporary
+    /// directory.
+    fn scratch_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("mic-unit-{}-{}", name, process::id()));
+        let _ = std::fs::remove_dir_all(&dir);
+        std::fs::create_dir_all(&dir).unwrap();
+        dir
+    }
+
+    /// Parses a mic command line, without the program name.
+    fn parse(args: &[&str]) -> Result<Args, clap::Error> {
+        Args::try_parse_from(std::iter::once("mic").chain(args.iter().copied()))
+    }
+
+    #[test]
+    fn args_are_consistent() {
+        use clap::CommandFactory;
+        Args::command().debug_assert();
+    }
+
+    #[test]
+    fn new_namespace_excludes_mount_namespace() {
+        assert!(parse(&["--target", "/mnt", "--new-namespace"]).is_ok());
+        assert!(parse(&["--target", "/mnt", "--mount-namespace", "/proc/1/ns/mnt"]).is_ok());
+        for other in [
+            ["--mount-namespace", "/proc/1/ns/mnt"],
+            ["--mount-namespace-pid", "1"],
+        ] {
+            let mut args = vec!["--target", "/mnt", "--new-namespace"];
+            args.extend(other);
+            let err = parse(&args).err().expect("conflicting namespaces accepted");
+            assert_eq!(err.kind(), clap::error::ErrorKind::ArgumentConflict);
+        }
+    }
+
+    #[test]
+    fn poll_ready_succeeds_once_probe_does() {
+        let calls = Arc::new(AtomicU32::new(0));
+        let counted = calls.clone();
+        let probe = move || match counted.fetch_add(1, Ordering::SeqCst) {
+            0 | 1 => Err(Errno::NOTCONN),
+            _ => Ok(()),
+        };
+        assert!(poll_ready(Path::new("/mnt"), Duration::from_secs(5), probe).is_ok());
+        assert_eq!(calls.load(Ordering::SeqCst), 3);
+    }
+
+    #[test]
+    fn poll_ready_times_out_with_last_error() {
+        let probe = || Err(Errno::NOTCONN);
+        let err = poll_ready(Path::new("/mnt"), Duration::from_millis(120), probe).unwrap_err();
+        assert!(
+            err.starts_with("/mnt not ready after 120ms: "),
+            "unexpected error: {}",
+            err
+        );
+        assert!(err.ends_with(&Errno::NOTCONN.to_string()));
+    }
+
+    #[test]
+    fn poll_ready_times_out_on_a_blocked_probe() {
+        // Like statfs on a FUSE mount whose daemon never answers
+        let probe = || {
+            thread::sleep(Duration::from_secs(3600));
+            Ok(())
+        };
+        let started = Instant::now();
+        let err = poll_ready(Path::new("/mnt"), Duration::from_millis(50), probe).unwrap_err();
+        assert_eq!(err, "/mnt not ready after 50ms");
+        assert!(started.elapsed() < Duration::from_secs(10));
+    }
+
+    #[test]
+    fn same_dir_through_symlink() {
+        let dir = scratch_dir("same-dir");
+        let (src, other) = (dir.join("src"), dir.join("other"));
+        std::fs::create_dir(&src).unwrap();
+        std::fs::create_dir(&other).unwrap();
+        std::os::unix::fs::symlink(&src, dir.join("link")).unwrap();
+
+        assert!(check_not_same_dir(&src, &other).is_ok());
+        assert!(check_not_same_dir(&src, &src).is_err());
+        let err = check_not_same_dir(&src, &dir.join("link")).unwrap_err();
+        assert!(err.ends_with("are the same directory"), "{}", err);
+        // Spelled differently, with a trailing . and ..
+        assert!(check_not_same_dir(&src, &dir.join("other/../src/.")).is_err());
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn rejected_options_fail_at_the_fsconfig_step() {
+        let config = parse(&["--target", "/mnt", "--fstype", "tmpfs"])
+            .unwrap()
+            .config()
+            .unwrap();
+        let err = MountError::Rejected {
+            fstype: "tmpfs".to_string(),
+            errors: vec![MountError::Fsconfig {
+                option: "bogus".to_string(),
+                errno: Errno::INVAL,
+                log: String::new(),
+            }],
+        };
+        let failure = mount_failure(&config, err);
+        assert_eq!(failure.status, EXIT_FSCONFIG);
+        assert!(failure
+            .msg
+            .starts_with("1 option(s) rejected by tmpfs: bogus: "));
+    }
+
+    /// A context that records what happens to it in a shared log.
+    struct StubContext {
+        id: usize,
+        events: Rc<RefCell<Vec<String>>>,
+    }
+
+    impl Probe for StubContext {
+        fn try_option(&self, opt: &FsOption) -> Result<(), String> {
+            self.events
+                .borrow_mut()
+                .push(format!("set {} on {}", opt, self.id));
+            if opt.key == "bogus" {
+                return Err("Unknown parameter 'bogus'".to_string());
+            }
+            Ok(())
+        }
+    }
+
+    impl Drop for StubContext {
+        fn drop(&mut self) {
+            self.events.borrow_mut().push(format!("close {}", self.id));
+        }
+    }
+
+    #[test]
+    fn probe_discards_each_context_before_the_next() {
+        let events = Rc::new(RefCell::new(Vec::new()));
+        let mut opened = 0;
+        let options: Vec<FsOption> = ["size=1M", "bogus", "mode=0700"]
+            .iter()
+            .map(|o| FsOption::parse(o).unwrap())
+            .collect();
+        let results = probe_each(&options, || {
+            opened += 1;
+            events.borrow_mut().push(format!("open {}", opened));
+            Ok(StubContext {
+                id: opened,
+                events: events.clone(),
+            })
+        });
+        assert_eq!(
+            results,
+            [Ok(()), Err("Unknown parameter 'bogus'".to_string()), Ok(())]
+        );
+        assert_eq!(
+            *events.borrow(),
+            [
+                "open 1",
+                "set size=1M on 1",
+                "close 1",
+                "open 2",
+                "set bogus on 2",
+                "close 2",
+                "open 3",
+                "set mode=0700 on 3",
+                "close 3",
+            ]
+        );
+    }
+
+    #[test]
+    fn probe_reports_a_failed_open_per_option() {
+        let options = [FsOption::parse("size=1M").unwrap()];
+        let results = probe_each::<StubContext>(&options, || Err("fsopen failed".to_string()));
+        assert_eq!(results, [Err("fsopen failed".to_string())]);
+    }
+
+    #[test]
+    fn dry_run_plan_shows_probe_steps() {
+        let args = parse(&[
+            "--target",
+            "/mnt",
+            "--fstype",
+            "tmpfs",
+            "-o",
+            "size=1M",
+            "--dry-run",
+            "--probe-options",
+        ])
+        .unwrap();
+        let config = args.config().unwrap();
+        assert_eq!(
+            probe_plan("tmpfs", &config),
+            [
+                "probe: fsopen(\"tmpfs\", FSOPEN_CLOEXEC) -> probe_fd",
+                "probe: fsconfig(probe_fd, FSCONFIG_SET_STRING, \"size\", \"1M\")",
+                "probe: close(probe_fd)",
+            ]
+        );
+    }
+
+    /// Both cases in one test, as umask is process-wide and tests run in
+    /// parallel.
+    #[test]
+    fn mkdir_umask_gives_exact_mode() {
+        let dir = scratch_dir("mkdir-umask");
+        let prev = umask(Mode::from_raw_mode(0o022));
+        let mode_of = |name: &str, extra: &[&str]| {
+            let target = dir.join(name).join("sub");
+            let target = target.to_str().unwrap();
+            let mut args = vec!["--target", target, "--mode", "777"];
+            args.extend(extra);
+            create_target(&parse(&args).unwrap().config().unwrap(), false).unwrap();
+            std::fs::metadata(target).unwrap().permissions().mode() & 0o777
+        };
+        let masked = mode_of("masked", &[]);
+        let exact = mode_of("exact", &["--mkdir-umask"]);
+        let after = umask(prev);
+        assert_eq!(masked, 0o755);
+        assert_eq!(exact, 0o777);
+        // and the umask is put back afterwards
+        assert_eq!(after, Mode::from_raw_mode(0o022));
+    }
+
+    #[test]
+    fn check_owner_compares_uids() {
+        let dir = scratch_dir("check-owner");
+        let me = geteuid().as_raw();
+        assert!(check_owner(&dir, me).is_ok());
+        assert_eq!(
+            check_owner(&dir, me + 1).unwrap_err(),
+            format!(
+                "target {} is owned by uid {}, expected {}",
+                dir.display(),
+                me,
+                me + 1
+            )
+        );
+        // A target that does not exist yet would be created as us
+        assert!(check_owner(&dir.join("missing"), me).is_ok());
+        assert!(check_owner(&dir.join("missing"), me + 1).is_err());
+    }
+
+    #[test]
+    fn list_options_needs_no_target() {
+        assert!(parse(&["--list-options", "tmpfs"]).is_ok());
+        assert!(parse(&[]).is_err());
+    }
+
+    #[test]
+    fn also_at_is_planned_after_the_primary_mount() {
+        let args = parse(&[
+            "--target",
+            "/mnt/a",
+            "--fstype",
+            "tmpfs",
+            "--also-at",
+            "/mnt/b",
+            "--also-at",
+            "/mnt/c",
+            "--then-ro",
+            "--dry-run",
+        ])
+        .unwrap();
+        let steps = plan(&args.config().unwrap()).unwrap();
+        let primary = steps
+            .iter()
+            .position(|s| s.starts_with("move_mount(mnt_fd"))
+            .unwrap();
+        let rest: Vec<&str> = steps[primary + 1..].iter().map(String::as_str).collect();
+        assert_eq!(
+            rest,
+            [
+                "open_tree(AT_FDCWD, \"/mnt/a\", OPEN_TREE_CLONE|OPEN_TREE_CLOEXEC|AT_RECURSIVE)",
+                "move_mount(clone_fd, \"\", AT_FDCWD, \"/mnt/b\", MOVE_MOUNT_F_EMPTY_PATH)",
+                "open_tree(AT_FDCWD, \"/mnt/a\", OPEN_TREE_CLONE|OPEN_TREE_CLOEXEC|AT_RECURSIVE)",
+                "move_mount(clone_fd, \"\", AT_FDCWD, \"/mnt/c\", MOVE_MOUNT_F_EMPTY_PATH)",
+                "mount_setattr(AT_FDCWD, \"/mnt/a\", 0, {attr_set: MOUNT_ATTR_RDONLY})",
+                "mount_setattr(AT_FDCWD, \"/mnt/b\", 0, {attr_set: MOUNT_ATTR_RDONLY})",
+                "mount_setattr(AT_FDCWD, \"/mnt/c\", 0, {attr_set: MOUNT_ATTR_RDONLY})",
+            ]
+        );
+    }
+
+    fn then_ro_steps(extra: &[&str]) -> Vec<String> {
+        let mut args = vec!["--target", "/mnt/a", "--then-ro", "--dry-run"];
+        args.extend(extra);
+        let steps = plan(&parse(&args).unwrap().config().unwrap()).unwrap();
+        steps
+            .into_iter()
+            .filter(|s| s.contains("MOUNT_ATTR_RDONLY"))
+            .collect()
+    }
+
+    #[test]
+    fn then_ro_follows_a_recursive_bind() {
+        assert_eq!(
+            then_ro_steps(&["--source", "/srv"]),
+            ["mount_setattr(AT_FDCWD, \"/mnt/a\", AT_RECURSIVE, {attr_set: MOUNT_ATTR_RDONLY})"]
+        );
+        assert_eq!(
+            then_ro_steps(&["--source", "/srv", "--no-recursive"]),
+            ["mount_setattr(AT_FDCWD, \"/mnt/a\", 0, {attr_set: MOUNT_ATTR_RDONLY})"]
+        );
+        assert_eq!(
+            then_ro_steps(&["--fstype", "tmpfs"]),
+            ["mount_setattr(AT_FDCWD, \"/mnt/a\", 0, {attr_set: MOUNT_ATTR_RDONLY})"]
+        );
+    }
+
+    fn config_hash(args: &[&str]) -> String {
+        let mut args = args.to_vec();
+        args.extend(["--target", "/mnt", "--fstype", "tmpfs"]);
+        parse(&args).unwrap().config().unwrap().hash().unwrap()
+    }
+
+    #[test]
+    fn config_hash_ignores_option_order() {
+        let hash = config_hash(&["-o", "size=1M", "-o", "mode=700"]);
+        assert_eq!(hash.len(), 64);
+        assert_eq!(hash, config_hash(&["-o", "mode=700", "-o", "size=1M"]));
+        assert_ne!(hash, config_hash(&["-o", "size=1M"]));
+        // The later of two values for one key wins, so those keep their order
+        assert_ne!(
+            config_hash(&["-o", "size=1M", "-o", "size=2M"]),
+            config_hash(&["-o", "size=2M", "-o", "size=1M"])
+        );
+    }
+
+    #[test]
+    fn config_hash_covers_only_the_mount() {
+        let hash = config_hash(&[]);
+        for extra in [
+            &["--proc-path", "/other/proc"][..],
+            &["--mkdir-retries", "9"],
+            &["--verify-magic"],
+        ] {
+            assert_eq!(hash, config_hash(extra), "{:?}", extra);
+        }
+        assert_ne!(hash, config_hash(&["--readonly"]));
+        assert_ne!(hash, config_hash(&["--also-at", "/mnt2"]));
+    }
+
+    #[test]
+    fn config_hash_covers_binary_option_contents() {
+        let dir = scratch_dir("config-hash");
+        let (a, b) = (dir.join("a"), dir.join("b"));
+        std::fs::write(&a, b"\x00\x01key").unwrap();
+        std::fs::write(&b, b"\x00\x01key").unwrap();
+        let opt = |file: &Path| format!("blob=@{}", file.display());
+        let hash = config_hash(&["--option-binary", &opt(&a)]);
+        // Same contents under another name
+        assert_eq!(hash, config_hash(&["--option-binary", &opt(&b)]));
+        std::fs::write(&b, b"\x00\x02key").unwrap();
+        assert_ne!(hash, config_hash(&["--option-binary", &opt(&b)]));
+
+        let args = parse(&[
+            "--target",
+            "/mnt",
+            "--fstype",
+            "tmpfs",
+            "--option-binary",
+            &opt(&a),
+        ])
+        .unwrap();
+        let config = args.config().unwrap();
+        std::fs::remove_file(&a).unwrap();
+        assert!(config.hash().unwrap_err().starts_with("reading "));
+    }
+
+    /// Work for with_timeout that pushes a step per name, recording its undo
+    /// in undone, and then blocks until block is dropped.
+    fn blocking_work(
+        names: &'static [&'static str],
+        undone: &Arc<Mutex<Vec<&'static str>>>,
+        block: mpsc::Receiver<()>,
+    ) -> impl FnOnce(&Cleanup) -> Result<i32, Failure> + Send + 'static {
+        let undone = undone.clone();
+        move |cleanup| {
+            let _guards: Vec<_> = names
+                .iter()
+                .map(|&name| {
+                    let undone = undone.clone();
+                    cleanup.push(name.to_string(), move || {
+                        undone.lock().unwrap().push(name);
+                        Ok(())
+                    })
+                })
+                .collect();
+            let _ = block.recv();
+            Ok(0)
+        }
+    }
+
+    #[test]
+    fn timeout_runs_cleanup_newest_first() {
+        let undone = Arc::new(Mutex::new(Vec::new()));
+        let (unblock, block) = mpsc::channel();
+        let work = blocking_work(&["close fs context", "unmount /mnt"], &undone, block);
+        let err = with_timeout(Duration::from_millis(100), work).unwrap_err();
+        assert_eq!(err.msg, "timed out after 100ms");
+        assert_eq!(
+            *undone.lock().unwrap(),
+            ["unmount /mnt", "close fs context"]
+        );
+        drop(unblock);
+    }
+
+    #[test]
+    fn no_cleanup_without_timeout() {
+        let undone = Arc::new(Mutex::new(Vec::new()));
+        let (unblock, block) = mpsc::channel();
+        unblock.send(()).unwrap();
+        let work = blocking_work(&["close fs context"], &undone, block);
+        assert_eq!(with_timeout(Duration::from_secs(5), work).unwrap(), 0);
+        assert!(undone.lock().unwrap().is_empty());
+    }
+
+    #[test]
+    fn finished_steps_leave_the_cleanup_stack() {
+        let undone = Arc::new(Mutex::new(Vec::new()));
+        let recorded = undone.clone();
+        let work = move |cleanup: &Cleanup| {
+            let record = |name: &'static str| {
+                let undone = recorded.clone();
+                move || {
+                    undone.lock().unwrap().push(name);
+                    Ok(())
+                }
+            };
+            // Done with before the hang, e.g. a closed context
+            drop(cleanup.push("done".to_string(), record("done")));
+            let _hung = cleanup.push("hung".to_string(), record("hung"));
+            thread::sleep(Duration::from_secs(5));
+            Ok(0)
+        };
+        assert!(with_timeout(Duration::from_millis(100), work).is_err());
+        assert_eq!(*undone.lock().unwrap(), ["hung"]);
+    }
+
+    #[test]
+    fn cleanup_reports_failures_and_goes_on() {
+        let cleanup = Cleanup::default();
+        let undone = Arc::new(Mutex::new(Vec::new()));
+        let first = undone.clone();
+        let _a = cleanup.push("first".to_string(), move || {
+            first.lock().unwrap().push("first");
+            Ok(())
+        });
+        let _b = cleanup.push("failing".to_string(), || Err("EBUSY".to_string()));
+        cleanup.run();
+        assert_eq!(*undone.lock().unwrap(), ["first"]);
+        // and the stack is empty afterwards
+        cleanup.run();
+        assert_eq!(undone.lock().unwrap().len(), 1);
+    }
+
+    #[test]
+    fn namespace_conditions_pick_options() {
+        let keys = |extra: &[&str]| {
+            let mut args = vec![
+                "--target",
+                "/mnt",
+                "--fstype",
+                "tmpfs",
+                "-o",
+                "@ns mode=0700",
+                "-o",
+                "@no-ns mode=0755",
+                "-o",
+                "size=1M",
+            ];
+            args.extend(extra);
+            let config = parse(&args).unwrap().config().unwrap();
+            applicable_options(&config)
+                .unwrap()
+                .iter()
+                .map(|opt| opt.to_string())
+                .collect::<Vec<_>>()
+        };
+        assert_eq!(keys(&[]), ["mode=0755", "size=1M"]);
+        assert_eq!(keys(&["--new-namespace"]), ["mode=0700", "size=1M"]);
+        assert_eq!(
+            keys(&["--mount-namespace", "/proc/1/ns/mnt"]),
+            ["mode=0700", "size=1M"]
+        );
+    }
+
+    fn confirm_answering(answer: &str, yes: bool, tty: bool) -> (Result<(), String>, String) {
+        let mut prompt = Vec::new();
+        let res = confirm_with(
+            "force-unmount /mnt",
+            yes,
+            tty,
+            &mut answer.as_bytes(),
+            &mut prompt,
+        );
+        (res, String::from_utf8(prompt).unwrap())
+    }
+
+    #[test]
+    fn confirm_refuses_without_a_terminal() {
+        let (res, prompt) = confirm_answering("y\n", false, false);
+        assert_eq!(
+            res.unwrap_err(),
+            "refusing to force-unmount /mnt without a terminal to confirm on; pass --yes to go ahead"
+        );
+        // Nothing was asked, or read
+        assert_eq!(prompt, "");
+        assert_eq!(confirm_answering("", true, false), (Ok(()), String::new()));
+    }
+
+    #[test]
+    fn confirm_asks_on_a_terminal() {
+        let (res, prompt) = confirm_answering("y\n", false, true);
+        assert_eq!(res, Ok(()));
+        assert_eq!(prompt, "force-unmount /mnt? [y/N] ");
+        assert!(confirm_answering("yes\n", false, true).0.is_ok());
+        for answer in ["n\n", "\n", "", "yep\n"] {
+            assert_eq!(
+                confirm_answering(answer, false, true).0.unwrap_err(),
+                "not confirmed, did not force-unmount /mnt"
+            );
+        }
+        // --yes does not ask
+        assert_eq!(
+            confirm_answering("n\n", true, true),
+            (Ok(()), String::new())
+        );
+    }
+
+    #[test]
+    fn yes_needs_confirm() {
+        let err = parse(&["--target", "/mnt", "--unmount", "--force", "--yes"])
+            .err()
+            .expect("--yes without --confirm accepted");
+        assert_eq!(err.kind(), clap::error::ErrorKind::MissingRequiredArgument);
+        assert!(parse(&[
+            "--target",
+            "/mnt",
+            "--unmount",
+            "--force",
+            "--confirm",
+            "--yes"
+        ])
+        .is_ok());
+    }
+
+    #[test]
+    fn reconfigure_sets_only_changed_options() {
+        let mount = MountInfo::parse(
+            "64 44 0:39 / /mnt rw,relatime - tmpfs none rw,size=1024k,mode=700,noswap,huge=never",
+        )
+        .unwrap();
+        let wanted: Vec<FsOption> = ["size=1024k", "mode=755", "noswap", "huge", "uid=0"]
+            .iter()
+            .map(|o| FsOption::parse(o).unwrap())
+            .collect();
+        let wanted: Vec<&FsOption> = wanted.iter().collect();
+        let changed: Vec<String> = changed_options(&wanted, &mount)
+            .iter()
+            .map(|opt| opt.to_string())
+            .collect();
+        assert_eq!(changed, ["mode=755", "huge", "uid=0"]);
+
+        // Nothing to do when everything matches
+        assert!(changed_options(&wanted[..1], &mount).is_empty());
+        // A value in another form than the kernel shows counts as a change
+        let size = FsOption::parse("size=1M").unwrap();
+        assert_eq!(changed_options(&[&size], &mount).len(), 1);
+    }
+
+    #[test]
+    fn uri_fills_the_config() {
+        let config = parse(&[
+            "--uri",
+            "tmpfs:///mnt/x?size=4M&mode=1777",
+            "-o",
+            "mode=700",
+        ])
+        .unwrap()
+        .config()
+        .unwrap();
+        assert_eq!(config.target, "/mnt/x");
+        assert_eq!(config.fstype.as_deref(), Some("tmpfs"));
+        // -o options come after the URI's, so they win
+        let options: Vec<String> = config.options.iter().map(|o| o.to_string()).collect();
+        assert_eq!(options, ["size=4M", "mode=1777", "mode=700"]);
+        assert!(parse(&["--uri", "tmpfs:///mnt/x", "--fstype", "ramfs"]).is_err());
+    }
+
+    #[test]
+    fn step_failures_carry_their_errno() {
+        let config = parse(&["--target", "/mnt", "--fstype", "tmpfs"])
+            .unwrap()
+            .config()
+            .unwrap();
+        let err = MountError::Fsopen {
+            fstype: "tmpfs".to_string(),
+            errno: Errno::NODEV,
+        };
+        let failure = mount_failure(&config, err);
+        assert_eq!(failure.status, EXIT_FSOPEN);
+        assert_eq!(failure.errno, Some(Errno::NODEV));
+        assert_eq!(Failure::from("plain".to_string()).errno, None);
+        let failure = open_namespace("mount", "/nonexistent/ns/mnt").unwrap_err();
+        assert_eq!(failure.status, EXIT_NAMESPACE);
+        assert_eq!(failure.errno, Some(Errno::NOENT));
+    }
+
+    #[test]
+    fn nested_target_is_a_mount_loop() {
+        let dir = scratch_dir("nested");
+        let (src, inner, other) = (dir.join("src"), dir.join("src/a/b"), dir.join("other"));
+        std::fs::create_dir_all(&inner).unwrap();
+        std::fs::create_dir(&other).unwrap();
+        std::os::unix::fs::symlink(&inner, other.join("link")).unwrap();
+
+        assert!(check_not_nested(&src, &other).is_ok());
+        // A sibling whose name starts with the source's is not inside it
+        std::fs::create_dir(dir.join("src2")).unwrap();
+        assert!(check_not_nested(&src, &dir.join("src2")).is_ok());
+        let err = check_not_nested(&src, &inner).unwrap_err();
+        assert_eq!(
+            err,
+            format!(
+                "target {} is inside source {}, which would create a mount loop",
+                inner.display(),
+                src.display()
+            )
+        );
+        // Reached through a symlink from outside the source
+        assert!(check_not_nested(&src, &other.join("link")).is_err());
+        // The source itself is check_not_same_dir's to report
+        assert!(check_not_nested(&src, &src).is_ok());
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn ns_inode_is_the_namespace_identity() {
+        // The kernel names a namespace link after the inode of the ns file
+        let link = std::fs::read_link("/proc/self/ns/mnt").unwrap();
+        let ino = ns_inode("/proc/self/ns/mnt").unwrap();
+        assert_eq!(link.to_str().unwrap(), format!("mnt:[{}]", ino));
+        assert!(ns_inode("/proc/self/ns/nosuchns").is_err());
+    }
+
+    #[test]
+    fn max_options_caps_the_merged_options() {
+        let count = |args: &[&str]| {
+            let mut args = args.to_vec();
+            args.extend(["--max-options", "2"]);
+            check_option_count(&parse(&args).unwrap().config().unwrap())
+        };
+        assert!(count(&[
+            "--target",
+            "/mnt",
+            "--fstype",
+            "tmpfs",
+            "-o",
+            "size=1M",
+            "-o",
+            "mode=0755"
+        ])
+        .is_ok());
+        assert_eq!(
+            count(&["--target", "/mnt", "--fstype", "tmpfs", "-o", "a", "-o", "b", "-o", "c"])
+                .unwrap_err(),
+            "3 options given, more than the maximum of 2"
+        );
+        // devpts brings three defaults of its own
+        assert_eq!(
+            count(&["--target", "/mnt", "--fstype", "devpts", "-o", "gid=5"]).unwrap_err(),
+            "4 options given, more than the maximum of 2"
+        );
+        assert!(count(&["--uri", "tmpfs:///mnt?size=1M&mode=0755&nr_inodes=10"]).is_err());
+    }
+
+    #[test]
+    fn max_option_len_defaults_to_the_fsconfig_limit() {
+        let config = |extra: &[&str]| {
+            let mut args = vec!["--target", "/mnt", "--fstype", "tmpfs"];
+            args.extend(extra);
+            parse(&args).unwrap().config().unwrap()
+        };
+        assert_eq!(config(&[]).max_option_len, 256);
+        assert_eq!(config(&["--max-option-len", "64"]).max_option_len, 64);
+    }
+
+    #[test]
+    fn proc_path_is_the_base_of_proc_lookups() {
+        let dir = scratch_dir("proc-path");
+        std::fs::create_dir(dir.join("1234")).unwrap();
+        let proc_path = dir.to_str().unwrap();
+        let config = parse(&[
+            "--target",
+            "/mnt",
+            "--fstype",
+            "tmpfs",
+            "--proc-path",
+            proc_path,
+            "--mount-namespace-pid",
+            "1234",
+        ])
+        .unwrap()
+        .config()
+        .unwrap();
+        assert_eq!(
+            config.proc_thread_self("ns/mnt"),
+            dir.join("thread-self/ns/mnt")
+        );
+        assert_eq!(
+            config.mount_namespace,
+            dir.join("1234/ns/mnt").to_str().unwrap()
+        );
+        assert_eq!(mount_options(&config).proc_path, Some(dir.clone()));
+        assert_eq!(
+            pid_namespace(proc_path, 99999).unwrap_err(),
+            format!("no process with PID 99999 (nothing at {}/99999)", proc_path)
+        );
+        let config = parse(&["--target", "/mnt", "--fstype", "tmpfs"])
+            .unwrap()
+            .config()
+            .unwrap();
+        assert_eq!(
+            config.proc_thread_self("filesystems"),
+            Path::new("/proc/thread-self/filesystems")
+        );
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn schema_matches_the_dumped_config() {
+        let config = parse(&[
+            "--target",
+            "/mnt",
+            "--fstype",
+            "tmpfs",
+            "-o",
+            "@6.4 @ns size=1M",
+            "--attrs",
+            "nosuid",
+        ])
+        .unwrap()
+        .config()
+        .unwrap();
+        let dumped = serde_json::to_value(&config).unwrap();
+        let schema = schema::config_schema();
+        let keys = |v: &serde_json::Value| -> Vec<String> {
+            v.as_object().unwrap().keys().cloned().collect()
+        };
+        assert_eq!(keys(&dumped), keys(&schema["properties"]));
+        let option_keys = keys(&schema["properties"]["options"]["items"]["properties"]);
+        for key in keys(&dumped["options"][0]) {
+            assert!(option_keys.contains(&key), "{}", key);
+        }
+    }
+
+    #[test]
+    fn attr_flags_combine_into_one_mask() {
+        let flags = |args: &[&str]| {
+            let mut args = args.to_vec();
+            args.extend(["--target", "/mnt", "--fstype", "tmpfs"]);
+            parse(&args).unwrap().attr_flags()
+        };
+        assert_eq!(flags(&[]), Ok(MountAttrFlags::empty()));
+        assert_eq!(
+            flags(&["--readonly", "--nosuid", "--nodev", "--noexec"]),
+            Ok(MountAttrFlags::MOUNT_ATTR_RDONLY
+                | MountAttrFlags::MOUNT_ATTR_NOSUID
+                | MountAttrFlags::MOUNT_ATTR_NODEV
+                | MountAttrFlags::MOUNT_ATTR_NOEXEC)
+        );
+        // The flags add to --attrs, and repeating one there is harmless
+        assert_eq!(
+            flags(&["--attrs", "nosuid,noatime", "--nosuid", "--noexec"]),
+            Ok(MountAttrFlags::MOUNT_ATTR_NOSUID
+                | MountAttrFlags::MOUNT_ATTR_NOATIME
+                | MountAttrFlags::MOUNT_ATTR_NOEXEC)
+        );
+        assert_eq!(
+            flags(&["--readonly", "--atime", "nodiratime"]),
+            Ok(MountAttrFlags::MOUNT_ATTR_RDONLY | MountAttrFlags::MOUNT_ATTR_NODIRATIME)
+        );
+    }
+
+    #[test]
+    fn split_options_is_opt_in() {
+        let options = |extra: &[&str]| -> Vec<String> {
+            let mut args = vec![
+                "--target",
+                "/mnt",
+                "--fstype",
+                "tmpfs",
+                "-o",
+                "size=1M,mode=0755",
+                "-o",
+                "context=\"a:b:c:s0:c1,c2\",nosuid",
+            ];
+            args.extend(extra);
+            let config = parse(&args).unwrap().config().unwrap();
+            config.options.iter().map(ToString::to_string).collect()
+        };
+        // Without the flag a comma is part of the value
+        assert_eq!(
+            options(&[]),
+            ["size=1M,mode=0755", "context=\"a:b:c:s0:c1,c2\",nosuid"]
+        );
+        assert_eq!(
+            options(&["--split-options"]),
+            ["size=1M", "mode=0755", "context=a:b:c:s0:c1,c2", "nosuid"]
+        );
+    }
+
+    #[test]
+    fn fsconfig_calls_keep_the_option_order() {
+        let fsconfig = |extra: &[&str]| -> Vec<String> {
+            let mut args = vec![
+                "--target",
+                "/mnt",
+                "--fstype",
+                "overlay",
+                "--source",
+                "ovl",
+                "-o",
+                "workdir=/w",
+                "-o",
+                "lowerdir=/l2:/l1",
+                "-o",
+                "upperdir=/u",
+                "-o",
+                "userxattr",
+                "--dry-run",
+            ];
+            args.extend(extra);
+            let steps = plan(&parse(&args).unwrap().config().unwrap()).unwrap();
+            steps
+                .into_iter()
+                .filter_map(|s| s.strip_prefix("fsconfig(fs_fd, ").map(str::to_string))
+                .collect()
+        };
+        let expected = [
+            "FSCONFIG_SET_STRING, \"source\", \"ovl\")",
+            "FSCONFIG_SET_STRING, \"workdir\", \"/w\")",
+            "FSCONFIG_SET_STRING, \"lowerdir\", \"/l2:/l1\")",
+            "FSCONFIG_SET_STRING, \"upperdir\", \"/u\")",
+            "FSCONFIG_SET_FLAG, \"userxattr\")",
+            "FSCONFIG_CMD_CREATE)",
+        ];
+        assert_eq!(fsconfig(&[]), expected);
+        let mut last = expected.to_vec();
+        last[..5].rotate_left(1);
+        assert_eq!(fsconfig(&["--source-last"]), last);
     }
 }
@@ -0,0 +1,370 @@
+//! Mounting in one call, for programs that embed mic.
+//!
+//! [`mount`] performs a complete mount. The steps it is made of,
+//! [`configure`], [`create`], [`clone_source`] and [`attach`], are the
+//! ones the mic binary calls, for callers that need to do more between
+//! them, e.g. idmap the mount or switch namespaces differently.
+
+use nix::sched::{setns, CloneFlags};
+use rustix::fs::{Mode, OFlags};
+use rustix::io::Errno;
+use rustix::mount::MountAttrFlags;
+use std::fs::File;
+use std::os::fd::{AsFd, AsRawFd, BorrowedFd, OwnedFd};
+use std::path::{Path, PathBuf};
+
+use crate::error::MountError;
+use crate::fs_context::FsContext;
+use crate::log::Log;
+use crate::ns::NamespaceGuard;
+use crate::options::FsOption;
+use crate::sys;
+
+/// What to mount where.
+#[derive(Clone, Debug)]
+pub struct MountOptions {
+    /// Existing directory to attach the mount at, resolved in mount_ns.
+    pub target: PathBuf,
+    /// Filesystem type to create with fsopen; None bind mounts source.
+    pub fstype: Option<String>,
+    /// Directory to bind, or the `source` parameter when fstype is set.
+    pub source: String,
+    /// Mount namespace to attach in, e.g. `/proc/<pid>/ns/mnt`; None
+    /// attaches in the caller's.
+    pub mount_ns: Option<PathBuf>,
+    /// fsconfig options, applied in order after source.
+    pub options: Vec<FsOption>,
+    /// Attributes the mount is created with.
+    pub attrs: MountAttrFlags,
+    /// Where procfs is mounted; None uses /proc.
+    pub proc_path: Option<PathBuf>,
+    /// Set source after the options instead of before them.
+    pub source_last: bool,
+    /// Open source read-write and set it with FSCONFIG_SET_FD instead of
+    /// as a path.
+    pub source_fd: bool,
+    /// Set every option and fail with [`MountError::Rejected`] listing all
+    /// rejected ones, instead of failing at the first.
+    pub continue_on_option_error: bool,
+    /// With continue_on_option_error, mount anyway and return the rejected
+    /// options in [`Applied::rejected`].
+    pub ignore_option_errors: bool,
+    /// If fsmount rejects attrs, drop the one attribute the filesystem
+    /// does not support instead of failing.
+    pub relax_attrs: bool,
+    /// Bind the mounts below source as well, like mount --rbind.
+    pub recursive: bool,
+}
+
+impl Default for MountOptions {
+    fn default() -> Self {
+        MountOptions {
+            target: PathBuf::new(),
+            fstype: None,
+            source: String::new(),
+            mount_ns: None,
+            options: Vec::new(),
+            attrs: MountAttrFlags::empty(),
+            proc_path: None,
+            source_last: false,
+            source_fd: false,
+            continue_on_option_error: false,
+            ignore_option_errors: false,
+            relax_attrs: false,
+            recursive: true,
+        }
+    }
+}
+
+/// What [`set_options`] set on a context.
+#[derive(Debug, Default)]
+pub struct Applied {
+    /// The options the filesystem accepted, in the order they were set.
+    pub options: Vec<String>,
+    /// The options it rejected, only ever non-empty with
+    /// ignore_option_errors.
+    pub rejected: Vec<MountError>,
+}
+
+/// The name and flag of a mount attribute relax_attrs had to drop.
+pub type DroppedAttr = (&'static str, MountAttrFlags);
+
+/// Creates the filesystem (or clones the bind source) as a detached mount in
+/// the caller's namespace, then attaches it at the target, in mount_ns if
+/// given.
+///
+/// Entering mount_ns uses setns, which the kernel refuses with EINVAL while
+/// the calling thread shares its filesystem information with other threads.
+/// Multi-threaded callers that set mount_ns should call this from a thread
+/// that has done unshare(CLONE_FS) first. The thread is returned to its
+/// original namespace before this returns.
+///
+/// Errors say which step failed; see [`MountError`].
+pub fn mount(opts: &MountOptions) -> Result<(), MountError> {
+    mount_logged(opts, &Log::quiet())
+}
+
+/// Like [`mount`], but logs each step to log as it is taken.
+pub fn mount_logged(opts: &MountOptions, log: &Log) -> Result<(), MountError> {
+    let mnt_fd = match &opts.fstype {
+        Some(fstype) => {
+            let (ctx, _) = configure(fstype, opts, log)?;
+            create(&ctx, fstype, opts, log)?.0
+        }
+        None => clone_source(Path::new(&opts.source), opts.recursive, log)?,
+    };
+    let Some(ns_path) = &opts.mount_ns else {
+        return attach(mnt_fd.as_fd(), &opts.target, log);
+    };
+    let proc_path = opts.proc_path.as_deref().unwrap_or(Path::new("/proc"));
+    // The calling thread's own namespace, which need not be the process's
+    let orig_ns = File::open(proc_path.join("thread-self/ns/mnt"))
+        .map(NamespaceGuard::new)
+        .map_err(|e| namespace_error("open original mount namespace".to_string(), io_errno(&e)))?;
+    let ns = File::open(ns_path).map_err(|e| {
+        namespace_error(
+            format!("open mount namespace {}", ns_path.display()),
+            io_errno(&e),
+        )
+    })?;
+    log.step(format_args!("setns to {}", ns_path.display()));
+    setns(&ns, CloneFlags::CLONE_NEWNS).map_err(|e| {
+        namespace_error(
+            format!("setns to {}", ns_path.display()),
+            Errno::from_raw_os_error(e as i32),
+        )
+    })?;
+    let attached = attach(mnt_fd.as_fd(), &opts.target, log);
+    log.step(format_args!("setns back to original namespace"));
+    orig_ns.restore().map_err(|e| {
+        namespace_error(
+            "setns back to original namespace".to_string(),
+            Errno::from_raw_os_error(e as i32),
+        )
+    })?;
+    attached
+}
+
+/// Opens an fs context for fstype and sets the source and options of opts
+/// on it with [`set_options`].
+pub fn configure(
+    fstype: &str,
+    opts: &MountOptions,
+    log: &Log,
+) -> Result<(FsContext, Applied), MountError> {
+    let ctx = FsContext::open(fstype).map_err(|errno| MountError::Fsopen {
+        fstype: fstype.to_string(),
+        errno,
+    })?;
+    log.step(format_args!(
+        "fsopen {} returned fd {}",
+        fstype,
+        ctx.as_fd().as_raw_fd()
+    ));
+    let applied = set_options(&ctx, fstype, opts, log)?;
+    Ok((ctx, applied))
+}
+
+/// Sets the source and options of opts on ctx, which may also come from
+/// fspick to reconfigure a mounted filesystem. Returns the options that
+/// were set and, with ignore_option_errors, the ones that were rejected.
+pub fn set_options(
+    ctx: &FsContext,
+    fstype: &str,
+    opts: &MountOptions,
+    log: &Log,
+) -> Result<Applied, MountError> {
+    let fsconfig_error = |option: String, errno| MountError::Fsconfig {
+        option,
+        errno,
+        log: ctx.drain_log(),
+    };
+    let set_source = || {
+        if opts.source.is_empty() {
+            return Ok(());
+        }
+        let set = if opts.source_fd {
+            let dev = rustix::fs::open(
+                opts.source.as_str(),
+                OFlags::RDWR | OFlags::CLOEXEC,
+                Mode::empty(),
+            )
+            .map_err(|errno| MountError::OpenDevice {
+                source: opts.source.clone(),
+                errno,
+            })?;
+            log.step(format_args!(
+                "fsconfig set source=fd {} ({})",
+                dev.as_raw_fd(),
+                opts.source
+            ));
+            ctx.set_source_fd(dev.as_fd())
+        } else {
+            log.step(format_args!("fsconfig set source={}", opts.source));
+            ctx.set_source(&opts.source)
+        };
+        set.map_err(|e| fsconfig_error(format!("source={}", opts.source), e))
+    };
+    let mut applied = Applied::default();
+    for setting in settings(opts) {
+        let opt = match setting {
+            Setting::Source => {
+                set_source()?;
+                continue;
+            }
+            Setting::Option(opt) => opt,
+        };
+        log.step(format_args!("fsconfig set {}", opt));
+        match ctx.set_option(opt) {
+            Ok(()) => applied.options.push(opt.to_string()),
+            Err(e) if opts.continue_on_option_error => {
+                applied.rejected.push(fsconfig_error(opt.to_string(), e));
+            }
+            Err(e) => return Err(fsconfig_error(opt.to_string(), e)),
+        }
+    }
+    if !applied.rejected.is_empty() && !opts.ignore_option_errors {
+        return Err(MountError::Rejected {
+            fstype: fstype.to_string(),
+            errors: applied.rejected,
+        });
+    }
+    Ok(applied)
+}
+
+/// One fsconfig call [`set_options`] makes.
+#[derive(Clone, Copy, Debug)]
+pub enum Setting<'a> {
+    /// The source, as a string or with source_fd as an fd.
+    Source,
+    Option(&'a FsOption),
+}
+
+/// Returns the fsconfig calls [`set_options`] makes for opts, in order: the
+/// source, if any, then the options, or with source_last the other way
+/// round. --dry-run lists the same.
+pub fn settings(opts: &MountOptions) -> Vec<Setting<'_>> {
+    let source = (!opts.source.is_empty()).then_some(Setting::Source);
+    let options = opts.options.iter().map(Setting::Option);
+    if opts.source_last {
+        options.chain(source).collect()
+    } else {
+        source.into_iter().chain(options).collect()
+    }
+}
+
+/// Creates the filesystem configured in ctx and returns a detached mount of
+/// it with the attributes of opts. With relax_attrs, also returns the name
+/// and flag of the attribute that had to be dropped, if any.
+pub fn create(
+    ctx: &FsContext,
+    fstype: &str,
+    opts: &MountOptions,
+    log: &Log,
+) -> Result<(OwnedFd, Option<DroppedAttr>), MountError> {
+    log.step(format_args!("fsconfig create"));
+    ctx.create().map_err(|errno| MountError::Create {
+        fstype: fstype.to_string(),
+        errno,
+        log: ctx.drain_log(),
+    })?;
+    let mounted = if opts.relax_attrs {
+        ctx.fsmount_relaxed(opts.attrs)
+    } else {
+        ctx.fsmount(opts.attrs).map(|fd| (fd, None))
+    };
+    let (fd, dropped) = mounted.map_err(|errno| MountError::Fsmount {
+        errno,
+        log: ctx.drain_log(),
+    })?;
+    log.step(format_args!("fsmount returned fd {}", fd.as_raw_fd()));
+    Ok((fd, dropped))
+}
+
+/// Returns a detached clone of the mount at source to bind elsewhere, with
+/// the mounts below it if recursive.
+pub fn clone_source(source: &Path, recursive: bool, log: &Log) -> Result<OwnedFd, MountError> {
+    let fd = sys::clone_tree(source, recursive).map_err(|errno| MountError::OpenTree {
+        source: source.display().to_string(),
+        errno,
+    })?;
+    log.step(format_args!(
+        "open_tree {} returned fd {}",
+        source.display(),
+        fd.as_raw_fd()
+    ));
+    Ok(fd)
+}
+
+/// Attaches the detached mount mnt_fd at target in the current mount
+/// namespace.
+pub fn attach(mnt_fd: BorrowedFd<'_>, target: &Path, log: &Log) -> Result<(), MountError> {
+    log.step(format_args!("move_mount to {}", target.display()));
+    sys::attach(mnt_fd, target).map_err(|errno| MountError::MoveMount {
+        target: target.to_path_buf(),
+        errno,
+    })
+}
+
+fn namespace_error(what: String, errno: Errno) -> MountError {
+    MountError::Namespace { what, errno }
+}
+
+fn io_errno(e: &std::io::Error) -> Errno {
+    Errno::from_io_error(e).unwrap_or(Errno::IO)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn opts(source: &str, options: &[&str], source_last: bool) -> MountOptions {
+        MountOptions {
+            fstype: Some("ext4".to_string()),
+            source: source.to_string(),
+            options: options
+                .iter()
+                .map(|o| FsOption::parse(o).unwrap())
+                .collect(),
+            source_last,
+            ..MountOptions::default()
+        }
+    }
+
+    /// Names each setting as it would be logged.
+    fn names(settings: &[Setting]) -> Vec<String> {
+        settings
+            .iter()
+            .map(|s| match s {
+                Setting::Source => "source".to_string(),
+                Setting::Option(opt) => opt.to_string(),
+            })
+            .collect()
+    }
+
+    #[test]
+    fn source_before_options_by_default() {
+        let opts = opts("/dev/sda1", &["ro", "errors=remount-ro"], false);
+        assert_eq!(
+            names(&settings(&opts)),
+            ["source", "ro", "errors=remount-ro"]
+        );
+    }
+
+    #[test]
+    fn source_last_after_options() {
+        let opts = opts("/dev/sda1", &["ro", "errors=remount-ro"], true);
+        assert_eq!(
+            names(&settings(&opts)),
+            ["ro", "errors=remount-ro", "source"]
+        );
+    }
+
+    #[test]
+    fn no_source_without_one() {
+        for source_last in [false, true] {
+            let opts = opts("", &["size=1M"], source_last);
+            assert_eq!(names(&settings(&opts)), ["size=1M"]);
+        }
+    }
+}
@@ -0,0 +1,179 @@
+//! Parsing of /proc/<pid>/mountinfo.
+
+use std::path::Path;
+
+/// One line of mountinfo, see proc(5).
+#[derive(Clone, Debug)]
+pub struct MountInfo {
+    pub mount_id: u32,
+    pub parent_id: u32,
+    pub mount_point: String,
+    /// Per-mount options, e.g. `rw,nosuid,relatime`.
+    pub mount_options: String,
+    /// The optional fields describing propagation, e.g. `shared:1` or
+    /// `master:2`; empty for a private mount.
+    pub propagation: Vec<String>,
+    pub fstype: String,
+    /// The filesystem's own options, e.g. `rw,size=65536k`.
+    pub super_options: String,
+}
+
+impl MountInfo {
+    pub fn parse(line: &str) -> Result<MountInfo, String> {
+        let invalid = || format!("invalid mountinfo line: {:?}", line);
+        let (pre, post) = line.split_once(" - ").ok_or_else(invalid)?;
+        // mount ID, parent ID, major:minor, root, mount point, options,
+        // then optional fields up to the separator
+        let fields: Vec<&str> = pre.split(' ').collect();
+        if fields.len() < 6 {
+            return Err(invalid());
+        }
+        // fstype, source, super options
+        let post: Vec<&str> = post.split(' ').collect();
+        if post.len() < 3 {
+            return Err(invalid());
+        }
+        Ok(MountInfo {
+            mount_id: fields[0].parse().map_err(|_| invalid())?,
+            parent_id: fields[1].parse().map_err(|_| invalid())?,
+            mount_point: unescape(fields[4]),
+            mount_options: fields[5].to_string(),
+            propagation: fields[6..].iter().map(|f| f.to_string()).collect(),
+            fstype: post[0].to_string(),
+            super_options: unescape(post[2]),
+        })
+    }
+}
+
+impl MountInfo {
+    /// Splits super_options into keys and values, e.g. `size=65536k` into
+    /// `("size", Some("65536k"))` and a flag like `noswap` into
+    /// `("noswap", None)`.
+    pub fn super_option_pairs(&self) -> Vec<(&str, Option<&str>)> {
+        self.super_options
+            .split(',')
+            .filter(|opt| !opt.is_empty())
+            .map(|opt| match opt.split_once('=') {
+                Some((key, value)) => (key, Some(value)),
+                None => (opt, None),
+            })
+            .collect()
+    }
+}
+
+/// Reads and parses the mountinfo file at path, in mount order.
+pub fn read(path: &Path) -> Result<Vec<MountInfo>, String> {
+    let data = std::fs::read_to_string(path)
+        .map_err(|e| format!("read {} failed: {}", path.display(), e))?;
+    data.lines().map(MountInfo::parse).collect()
+}
+
+/// Returns the mounts whose mount point is exactly path. Mounts below path
+/// are not included.
+pub fn mounts_at<'a>(mounts: &'a [MountInfo], path: &Path) -> Vec<&'a MountInfo> {
+    mounts
+        .iter()
+        .filter(|m| Path::new(&m.mount_point) == path)
+        .collect()
+}
+
+/// Returns the mount path resides on: the one with the longest mount point
+/// that is a prefix of path, and of those the most recently mounted.
+pub fn containing_mount<'a>(mounts: &'a [MountInfo], path: &Path) -> Option<&'a MountInfo> {
+    mounts
+        .iter()
+        .filter(|m| path.starts_with(&m.mount_point))
+        .max_by_key(|m| Path::new(&m.mount_point).components().count())
+}
+
+/// Decodes the octal escapes (\040 for space etc.) the kernel uses for
+/// whitespace and backslashes in paths.
+fn unescape(s: &str) -> String {
+    let bytes = s.as_bytes();
+    let mut out = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        if bytes[i] == b'\\'
+            && i + 3 < bytes.len()
+            && bytes[i + 1..i + 4]
+                .iter()
+                .all(|b| (b'0'..=b'7').contains(b))
+        {
+            let oct = std::str::from_utf8(&bytes[i + 1..i + 4]).unwrap();
+            out.push(u8::from_str_radix(oct, 8).unwrap_or(b'?'));
+            i += 4;
+        } else {
+            out.push(bytes[i]);
+            i += 1;
+        }
+    }
+    String::from_utf8_lossy(&out).into_owned()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const SAMPLE: &str = "\
+22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+23 22 0:21 / /mnt rw,nosuid shared:2 - tmpfs tmpfs rw,size=65536k
+24 23 0:22 / /mnt/sub rw - tmpfs tmpfs rw
+25 23 0:23 / /mnt rw master:2 - tmpfs tmpfs rw,size=1024k
+26 22 0:24 / /mnt2 rw - tmpfs tmpfs rw";
+
+    fn sample() -> Vec<MountInfo> {
+        SAMPLE
+            .lines()
+            .map(|l| MountInfo::parse(l).unwrap())
+            .collect()
+    }
+
+    fn ids(mounts: &[&MountInfo]) -> Vec<u32> {
+        mounts.iter().map(|m| m.mount_id).collect()
+    }
+
+    #[test]
+    fn parse_line() {
+        let m = MountInfo::parse(
+            "36 35 98:0 /mnt1 /mnt/my\\040dir rw,noatime master:1 shared:3 - ext3 /dev/root rw,errors=continue",
+        )
+        .unwrap();
+        assert_eq!(m.mount_id, 36);
+        assert_eq!(m.parent_id, 35);
+        assert_eq!(m.mount_point, "/mnt/my dir");
+        assert_eq!(m.mount_options, "rw,noatime");
+        assert_eq!(m.propagation, ["master:1", "shared:3"]);
+        assert_eq!(m.fstype, "ext3");
+        assert_eq!(m.super_options, "rw,errors=continue");
+        assert!(MountInfo::parse("36 35 98:0 / /mnt rw").is_err());
+    }
+
+    #[test]
+    fn mounts_at_exact_target_only() {
+        let mounts = sample();
+        // Both mounts stacked at /mnt, oldest first, but not /mnt/sub
+        assert_eq!(ids(&mounts_at(&mounts, Path::new("/mnt"))), [23, 25]);
+        assert_eq!(ids(&mounts_at(&mounts, Path::new("/mnt/sub"))), [24]);
+        // A directory below a mount has nothing at it
+        assert!(mounts_at(&mounts, Path::new("/mnt/other")).is_empty());
+        // Nor does a path that merely shares a prefix
+        assert!(mounts_at(&mounts, Path::new("/mn")).is_empty());
+    }
+
+    #[test]
+    fn containing_mount_resolves_parent() {
+        let mounts = sample();
+        let id = |path: &str| containing_mount(&mounts, Path::new(path)).map(|m| m.mount_id);
+        // The topmost of the two mounts at /mnt
+        assert_eq!(id("/mnt/dir"), Some(25));
+        assert_eq!(id("/mnt"), Some(25));
+        assert_eq!(id("/mnt/sub/dir"), Some(24));
+        // /mnt2 is not below /mnt, whatever the string prefix says
+        assert_eq!(id("/mnt2/dir"), Some(26));
+        assert_eq!(id("/srv"), Some(22));
+        assert_eq!(
+            containing_mount(&[], Path::new("/srv")).map(|m| m.mount_id),
+            None
+        );
+    }
+}
@@ -0,0 +1,52 @@
+//! Returning the calling thread to its original mount namespace.
+
+use nix::sched::{setns, CloneFlags};
+use std::fs::File;
+
+/// The mount namespace a thread started in, held open while the thread is
+/// switched into another one with setns or unshare.
+///
+/// Dropping the guard switches the thread back, so every way out of the
+/// scope that entered the other namespace, early returns included, leaves
+/// the thread where it started. Call [`NamespaceGuard::restore`] on the
+/// normal path to find out whether switching back worked.
+#[derive(Debug)]
+pub struct NamespaceGuard {
+    orig: Option<File>,
+}
+
+impl NamespaceGuard {
+    /// Takes orig, the thread's own ns/mnt opened before leaving it.
+    pub fn new(orig: File) -> Self {
+        NamespaceGuard { orig: Some(orig) }
+    }
+
+    /// Returns the open original namespace, e.g. to stat it.
+    pub fn original(&self) -> &File {
+        self.orig.as_ref().expect("namespace already restored")
+    }
+
+    /// Gives up on switching back, for when that can no longer work, e.g.
+    /// after joining a user namespace without privileges over the original
+    /// mount namespace.
+    pub fn release(mut self) {
+        self.orig = None;
+    }
+
+    /// Switches the thread back to the original namespace now.
+    pub fn restore(mut self) -> nix::Result<()> {
+        match self.orig.take() {
+            Some(orig) => setns(&orig, CloneFlags::CLONE_NEWNS),
+            None => Ok(()),
+        }
+    }
+}
+
+impl Drop for NamespaceGuard {
+    fn drop(&mut self) {
+        if let Some(orig) = self.orig.take() {
+            // Nothing to report the error to; the thread stays where it is.
+            let _ = setns(&orig, CloneFlags::CLONE_NEWNS);
+        }
+    }
+}
@@ -0,0 +1,624 @@
+//! Parsing and application of `-o` filesystem options.
+
+use rustix::fs::{open, Mode, OFlags};
+use rustix::io::Errno;
+use rustix::mount::{
+    fsconfig_set_binary, fsconfig_set_fd, fsconfig_set_flag, fsconfig_set_path,
+    fsconfig_set_path_empty, fsconfig_set_string,
+};
+use serde::{Serialize, Serializer};
+use std::fmt;
+use std::os::fd::{AsFd, BorrowedFd};
+
+/// A kernel release reduced to the major and minor numbers that gate features.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord)]
+pub struct KernelVersion {
+    pub major: u32,
+    pub minor: u32,
+}
+
+impl KernelVersion {
+    /// Parses "6.4", "6.4.0" or a full release string like "6.8.0-45-generic".
+    pub fn parse(s: &str) -> Result<KernelVersion, String> {
+        let mut parts = s.split('.');
+        let mut next = || -> Option<u32> {
+            let part = parts.next()?;
+            let digits = part
+                .find(|c: char| !c.is_ascii_digit())
+                .map_or(part, |end| &part[..end]);
+            digits.parse().ok()
+        };
+        match (next(), next()) {
+            (Some(major), Some(minor)) => Ok(KernelVersion { major, minor }),
+            _ => Err(format!("invalid kernel version: {:?}", s)),
+        }
+    }
+
+    /// Returns the version of the running kernel as reported by uname(2).
+    pub fn running() -> Result<KernelVersion, String> {
+        let uname = rustix::system::uname();
+        KernelVersion::parse(&uname.release().to_string_lossy())
+    }
+}
+
+impl fmt::Display for KernelVersion {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}.{}", self.major, self.minor)
+    }
+}
+
+impl Serialize for KernelVersion {
+    fn serialize<S: Serializer>(&self, s: S) -> Result<S::Ok, S::Error> {
+        s.collect_str(self)
+    }
+}
+
+/// The largest value FSCONFIG_SET_BINARY accepts.
+pub const MAX_BINARY_LEN: u64 = 1024 * 1024;
+
+/// The most bytes fsconfig copies for a key or string value, the
+/// terminating NUL included; anything longer fails with EINVAL and nothing
+/// in the context's log.
+pub const MAX_OPTION_LEN: usize = 256;
+
+/// How the value of an option is passed to fsconfig.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ValueKind {
+    /// FSCONFIG_SET_STRING, or FSCONFIG_SET_FLAG without a value.
+    #[default]
+    String,
+    /// FSCONFIG_SET_BINARY with the contents of the file named by the value.
+    Binary,
+    /// FSCONFIG_SET_PATH with the value as a path relative to the current
+    /// directory.
+    Path,
+    /// FSCONFIG_SET_PATH_EMPTY with an O_PATH fd of the value.
+    PathEmpty,
+    /// FSCONFIG_SET_FD with an O_RDWR fd of the value.
+    Fd,
+    /// FSCONFIG_SET_FD with a read-only fd of the directory named by the
+    /// value.
+    DirFd,
+}
+
+impl ValueKind {
+    fn is_string(&self) -> bool {
+        *self == ValueKind::String
+    }
+}
+
+/// A single `-o` entry, applied with one fsconfig call.
+///
+/// `key=value` is set with FSCONFIG_SET_STRING and a bare `key` with
+/// FSCONFIG_SET_FLAG. An entry may be prefixed with conditions, each
+/// followed by a space:
+///
+/// - `@<version>` only applies it on kernels at least that new, e.g.
+///   `@6.4 noswap`
+/// - `@ns` only applies it when mounting into another mount namespace, and
+///   `@no-ns` only when mounting in the current one
+#[derive(Clone, Debug, Serialize)]
+pub struct FsOption {
+    pub key: String,
+    pub value: Option<String>,
+    pub min_kernel: Option<KernelVersion>,
+    /// Some(true) for `@ns`, Some(false) for `@no-ns`.
+    pub in_namespace: Option<bool>,
+    /// Left out of the serialized form for string options, so that config
+    /// hashes from before other kinds existed stay the same.
+    #[serde(default, skip_serializing_if = "ValueKind::is_string")]
+    pub kind: ValueKind,
+}
+
+impl FsOption {
+    pub fn parse(s: &str) -> Result<FsOption, String> {
+        let mut min_kernel = None;
+        let mut in_namespace = None;
+        let mut spec = s;
+        while let Some(rest) = spec.strip_prefix('@') {
+            let Some((cond, opt)) = rest.split_once(char::is_whitespace) else {
+                return Err(format!("missing option after condition in {:?}", s));
+            };
+            match cond {
+                "ns" => in_namespace = Some(true),
+                "no-ns" => in_namespace = Some(false),
+                _ => min_kernel = Some(KernelVersion::parse(cond)?),
+            }
+            spec = opt.trim_start();
+        }
+        let (key, value) = split_key(spec, s)?;
+        Ok(FsOption {
+            key,
+            value,
+            min_kernel,
+            in_namespace,
+            kind: ValueKind::String,
+        })
+    }
+
+    /// Parses a `key=@<file>` entry for --option-binary. The file must exist
+    /// and fit in the MAX_BINARY_LEN bytes the kernel accepts; it is read
+    /// when the option is applied.
+    pub fn parse_binary(s: &str) -> Result<FsOption, String> {
+        let Some((key, file)) = s.split_once("=@") else {
+            return Err(format!("expected key=@<file>, got {:?}", s));
+        };
+        if key.is_empty() {
+            return Err(format!("empty option key in {:?}", s));
+        }
+        let len = std::fs::metadata(file)
+            .map_err(|e| format!("stat {} failed: {}", file, e))?
+            .len();
+        if len == 0 || len > MAX_BINARY_LEN {
+            return Err(format!(
+                "{} is {} bytes, fsconfig takes binary values of 1 to {} bytes",
+                file, len, MAX_BINARY_LEN
+            ));
+        }
+        Ok(FsOption {
+            key: key.to_string(),
+            value: Some(file.to_string()),
+            min_kernel: None,
+            in_namespace: None,
+            kind: ValueKind::Binary,
+        })
+    }
+
+    /// Parses a `key=<path>` entry for --option-path.
+    pub fn parse_path(s: &str) -> Result<FsOption, String> {
+        FsOption::parse_path_kind(s, ValueKind::Path)
+    }
+
+    /// Parses a `key=<path>` entry for --option-path-empty.
+    pub fn parse_path_empty(s: &str) -> Result<FsOption, String> {
+        FsOption::parse_path_kind(s, ValueKind::PathEmpty)
+    }
+
+    /// Parses a `key=<path>` entry for --option-fd.
+    pub fn parse_fd(s: &str) -> Result<FsOption, String> {
+        FsOption::parse_path_kind(s, ValueKind::Fd)
+    }
+
+    fn parse_path_kind(s: &str, kind: ValueKind) -> Result<FsOption, String> {
+        let (key, Some(path)) = split_key(s, s)? else {
+            return Err(format!("expected key=<path>, got {:?}", s));
+        };
+        if path.is_empty() {
+            return Err(format!("empty path in {:?}", s));
+        }
+        Ok(FsOption {
+            key,
+            value: Some(path),
+            min_kernel: None,
+            in_namespace: None,
+            kind,
+        })
+    }
+
+    /// Splits an entry holding a mount(8)-style list such as
+    /// `size=64M,mode=0755,nosuid` into one entry per item, each with the
+    /// same conditions. As in mount(8), double quotes keep commas in a value
+    /// together, as in `context="system_u:object_r:tmp_t:s0:c1,c2"`; the
+    /// quotes themselves are dropped. Empty items are skipped.
+    pub fn split_commas(&self) -> Result<Vec<FsOption>, String> {
+        if !self.kind.is_string() {
+            return Ok(vec![self.clone()]);
+        }
+        let spec = self.to_string();
+        split_list(&spec)?
+            .iter()
+            .filter(|item| !item.is_empty())
+            .map(|item| {
+                let (key, value) = split_key(item, &spec)?;
+                Ok(FsOption {
+                    key,
+                    value,
+                    ..self.clone()
+                })
+            })
+            .collect()
+    }
+
+    /// Reports whether the option should be applied on the given kernel.
+    pub fn applies_to(&self, kernel: KernelVersion) -> bool {
+        self.min_kernel.is_none_or(|min| kernel >= min)
+    }
+
+    /// Reports whether the option should be applied when mounting into
+    /// another mount namespace (namespaced) or the current one.
+    pub fn applies_in(&self, namespaced: bool) -> bool {
+        self.in_namespace.is_none_or(|want| want == namespaced)
+    }
+
+    /// Rejects keys and values containing control characters such as a
+    /// newline or NUL, which are almost always a quoting mistake and would
+    /// otherwise garble the kernel log or get the string cut short.
+    pub fn check_chars(&self) -> Result<(), String> {
+        if self.key.contains(char::is_control) {
+            return Err(format!(
+                "option key {:?} contains a control character",
+                self.key
+            ));
+        }
+        if let Some(value) = &self.value {
+            if value.contains(char::is_control) {
+                return Err(format!(
+                    "value of option {} contains a control character: {:?}",
+                    self.key, value
+                ));
+            }
+        }
+        Ok(())
+    }
+
+    /// Rejects a key or string value that, with its terminating NUL, is
+    /// longer than max bytes. A binary option's value names a file, whose
+    /// size parse_binary has checked already.
+    pub fn check_len(&self, max: usize) -> Result<(), String> {
+        let too_long = |s: &str| s.len() + 1 > max;
+        if too_long(&self.key) {
+            return Err(format!(
+                "option key {:?} is {} bytes, more than the {} that fit in {} with the NUL",
+                self.key,
+                self.key.len(),
+                max.saturating_sub(1),
+                max
+            ));
+        }
+        match (&self.value, self.kind) {
+            (Some(value), ValueKind::String) if too_long(value) => Err(format!(
+                "value of option {} is {} bytes, more than the {} that fit in {} with the NUL",
+                self.key,
+                value.len(),
+                max.saturating_sub(1),
+                max
+            )),
+            _ => Ok(()),
+        }
+    }
+
+    /// Describes the fsconfig command and arguments apply uses, for
+    /// --dry-run.
+    pub fn plan(&self) -> String {
+        match (self.kind, &self.value) {
+            (ValueKind::Binary, Some(file)) => format!(
+                "FSCONFIG_SET_BINARY, {:?}, <contents of {}>, <length>",
+                self.key, file
+            ),
+            (ValueKind::Path, Some(path)) => {
+                format!("FSCONFIG_SET_PATH, {:?}, {:?}, AT_FDCWD", self.key, path)
+            }
+            (ValueKind::PathEmpty, Some(path)) => format!(
+                "FSCONFIG_SET_PATH_EMPTY, {:?}, \"\", <O_PATH fd of {}>",
+                self.key, path
+            ),
+            (ValueKind::Fd, Some(path)) => format!(
+                "FSCONFIG_SET_FD, {:?}, NULL, <O_RDWR fd of {}>",
+                self.key, path
+            ),
+            (ValueKind::DirFd, Some(path)) => format!(
+                "FSCONFIG_SET_FD, {:?}, NULL, <O_DIRECTORY fd of {}>",
+                self.key, path
+            ),
+            (_, Some(value)) => format!("FSCONFIG_SET_STRING, {:?}, {:?}", self.key, value),
+            (_, None) => format!("FSCONFIG_SET_FLAG, {:?}", self.key),
+        }
+    }
+
+    /// Sets the option on an fs context obtained from fsopen.
+    ///
+    /// The key and value reach the kernel byte for byte: they are the UTF-8
+    /// of the command line argument, copied into a NUL-terminated string
+    /// without any locale or Unicode normalization. A NUL inside either one
+    /// cannot be passed and fails with EINVAL. A binary option's file is
+    /// read and a path-empty or fd option's path opened here, and errors doing so
+    /// are returned as their errno.
+    pub fn apply(&self, fs_fd: BorrowedFd<'_>) -> rustix::io::Result<()> {
+        match (self.kind, &self.value) {
+            (ValueKind::Binary, Some(file)) => {
+                let data = std::fs::read(file)
+                    .map_err(|e| Errno::from_io_error(&e).unwrap_or(Errno::IO))?;
+                fsconfig_set_binary(fs_fd, self.key.as_str(), &data)
+            }
+            (ValueKind::Path, Some(path)) => {
+                fsconfig_set_path(fs_fd, self.key.as_str(), path.as_str(), rustix::fs::CWD)
+            }
+            (ValueKind::PathEmpty, Some(path)) => {
+                let fd = open(path.as_str(), OFlags::PATH | OFlags::CLOEXEC, Mode::empty())?;
+                fsconfig_set_path_empty(fs_fd, self.key.as_str(), fd.as_fd())
+            }
+            (ValueKind::Fd, Some(path)) => {
+                let fd = open(path.as_str(), OFlags::RDWR | OFlags::CLOEXEC, Mode::empty())?;
+                fsconfig_set_fd(fs_fd, self.key.as_str(), fd.as_fd())
+            }
+            (ValueKind::DirFd, Some(path)) => {
+                let fd = open(
+                    path.as_str(),
+                    OFlags::RDONLY | OFlags::DIRECTORY | OFlags::CLOEXEC,
+                    Mode::empty(),
+                )?;
+                fsconfig_set_fd(fs_fd, self.key.as_str(), fd.as_fd())
+            }
+            (_, Some(value)) => fsconfig_set_string(fs_fd, self.key.as_str(), value.as_str()),
+            (_, None) => fsconfig_set_flag(fs_fd, self.key.as_str()),
+        }
+    }
+}
+
+/// Splits spec at the commas outside double quotes, removing the quotes.
+fn split_list(spec: &str) -> Result<Vec<String>, String> {
+    let mut items = vec![String::new()];
+    let mut quoted = false;
+    for c in spec.chars() {
+        match c {
+            '"' => quoted = !quoted,
+            ',' if !quoted => items.push(String::new()),
+            c => items.last_mut().unwrap().push(c),
+        }
+    }
+    if quoted {
+        return Err(format!("unterminated quote in {:?}", spec));
+    }
+    Ok(items)
+}
+
+/// Splits spec into key and optional value at the first '='. whole is the
+/// full entry, for the error message.
+fn split_key(spec: &str, whole: &str) -> Result<(String, Option<String>), String> {
+    let (key, value) = match spec.split_once('=') {
+        Some((key, value)) => (key, Some(value.to_string())),
+        None => (spec, None),
+    };
+    if key.is_empty() {
+        return Err(format!("empty option key in {:?}", whole));
+    }
+    Ok((key.to_string(), value))
+}
+
+impl fmt::Display for FsOption {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match (self.kind, &self.value) {
+            (ValueKind::Binary, Some(file)) => write!(f, "{}=@{}", self.key, file),
+            (_, Some(value)) => write!(f, "{}={}", self.key, value),
+            (_, None) => write!(f, "{}", self.key),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn kernel(major: u32, minor: u32) -> KernelVersion {
+        KernelVersion { major, minor }
+    }
+
+    #[test]
+    fn kernel_version_parse() {
+        assert_eq!(KernelVersion::parse("6.4").unwrap(), kernel(6, 4));
+        assert_eq!(KernelVersion::parse("6.4.0").unwrap(), kernel(6, 4));
+        assert_eq!(
+            KernelVersion::parse("6.8.0-45-generic").unwrap(),
+            kernel(6, 8)
+        );
+        assert_eq!(KernelVersion::parse("5.15rc2").unwrap(), kernel(5, 15));
+        assert!(KernelVersion::parse("6").is_err());
+        assert!(KernelVersion::parse("six.four").is_err());
+        assert!(kernel(6, 10) > kernel(6, 9));
+        assert!(kernel(7, 0) > kernel(6, 19));
+    }
+
+    #[test]
+    fn min_kernel_skip_and_apply() {
+        let opt = FsOption::parse("@6.4 noswap").unwrap();
+        assert_eq!(opt.key, "noswap");
+        assert_eq!(opt.value, None);
+        assert_eq!(opt.min_kernel, Some(kernel(6, 4)));
+        assert!(!opt.applies_to(kernel(6, 3)));
+        assert!(!opt.applies_to(kernel(5, 19)));
+        assert!(opt.applies_to(kernel(6, 4)));
+        assert!(opt.applies_to(kernel(6, 12)));
+        assert!(opt.applies_to(kernel(7, 0)));
+
+        let opt = FsOption::parse("size=1M").unwrap();
+        assert_eq!(opt.min_kernel, None);
+        assert!(opt.applies_to(kernel(2, 6)));
+    }
+
+    #[test]
+    fn min_kernel_errors() {
+        assert!(FsOption::parse("@6.4").is_err());
+        assert!(FsOption::parse("@x.y noswap").is_err());
+    }
+
+    #[test]
+    fn option_length_counts_the_nul() {
+        let opt = |key: &str, value: &str| FsOption::parse(&format!("{}={}", key, value)).unwrap();
+        let fits = "x".repeat(MAX_OPTION_LEN - 1);
+        assert!(opt("a", &fits).check_len(MAX_OPTION_LEN).is_ok());
+        assert!(opt(&fits, "b").check_len(MAX_OPTION_LEN).is_ok());
+        let over = "x".repeat(MAX_OPTION_LEN);
+        assert_eq!(
+            opt("a", &over).check_len(MAX_OPTION_LEN).unwrap_err(),
+            "value of option a is 256 bytes, more than the 255 that fit in 256 with the NUL"
+        );
+        assert!(opt(&over, "b").check_len(MAX_OPTION_LEN).is_err());
+        assert!(FsOption::parse("noswap").unwrap().check_len(7).is_ok());
+        assert!(FsOption::parse("noswap").unwrap().check_len(6).is_err());
+    }
+
+    #[test]
+    fn control_characters_are_rejected() {
+        assert!(FsOption::parse("size=1M").unwrap().check_chars().is_ok());
+        // Non-ASCII text is fine
+        assert!(FsOption::parse("context=système")
+            .unwrap()
+            .check_chars()
+            .is_ok());
+        let err = FsOption::parse("size=1M\nmode=700")
+            .unwrap()
+            .check_chars()
+            .unwrap_err();
+        assert_eq!(
+            err,
+            "value of option size contains a control character: \"1M\\nmode=700\""
+        );
+        let err = FsOption::parse("no\tswap")
+            .unwrap()
+            .check_chars()
+            .unwrap_err();
+        assert_eq!(err, "option key \"no\\tswap\" contains a control character");
+        assert!(FsOption::parse("uid=0\0").unwrap().check_chars().is_err());
+    }
+
+    #[test]
+    fn namespace_conditions() {
+        let opt = FsOption::parse("@ns mode=0700").unwrap();
+        assert_eq!(opt.in_namespace, Some(true));
+        assert_eq!(opt.value.as_deref(), Some("0700"));
+        assert!(opt.applies_in(true));
+        assert!(!opt.applies_in(false));
+
+        let opt = FsOption::parse("@no-ns mode=0755").unwrap();
+        assert_eq!(opt.in_namespace, Some(false));
+        assert!(!opt.applies_in(true));
+        assert!(opt.applies_in(false));
+
+        let opt = FsOption::parse("mode=0755").unwrap();
+        assert!(opt.applies_in(true) && opt.applies_in(false));
+    }
+
+    #[test]
+    fn conditions_combine() {
+        let opt = FsOption::parse("@ns @6.4 noswap").unwrap();
+        assert_eq!(opt.key, "noswap");
+        assert_eq!(opt.in_namespace, Some(true));
+        assert_eq!(opt.min_kernel, Some(kernel(6, 4)));
+        assert_eq!(
+            FsOption::parse("@6.4  @no-ns  noswap")
+                .unwrap()
+                .in_namespace,
+            Some(false)
+        );
+        assert!(FsOption::parse("@ns").is_err());
+    }
+
+    #[test]
+    fn multibyte_values_are_kept_byte_for_byte() {
+        let spec = "label=Données-ラベル-€";
+        let opt = FsOption::parse(spec).unwrap();
+        assert_eq!(opt.key, "label");
+        assert_eq!(opt.value.as_deref(), Some("Données-ラベル-€"));
+        assert_eq!(opt.to_string().as_bytes(), spec.as_bytes());
+        assert!(opt.check_chars().is_ok());
+        let split = FsOption::parse("label=ü,name=\"a,ß\"")
+            .unwrap()
+            .split_commas()
+            .unwrap();
+        let values: Vec<_> = split.iter().map(|o| o.value.as_deref().unwrap()).collect();
+        assert_eq!(values, ["ü", "a,ß"]);
+    }
+
+    fn split(spec: &str) -> Result<Vec<String>, String> {
+        let opts = FsOption::parse(spec)?.split_commas()?;
+        Ok(opts.iter().map(ToString::to_string).collect())
+    }
+
+    #[test]
+    fn split_commas_like_mount() {
+        assert_eq!(
+            split("size=64M,mode=0755,nosuid").unwrap(),
+            ["size=64M", "mode=0755", "nosuid"]
+        );
+        assert_eq!(split("size=64M").unwrap(), ["size=64M"]);
+        assert_eq!(split("nosuid").unwrap(), ["nosuid"]);
+        // Only the first = separates key and value
+        assert_eq!(split("a=b=c,d").unwrap(), ["a=b=c", "d"]);
+    }
+
+    #[test]
+    fn split_commas_skips_empty_items() {
+        assert_eq!(split("a,,b,").unwrap(), ["a", "b"]);
+        assert_eq!(split("a,\"\",b").unwrap(), ["a", "b"]);
+    }
+
+    #[test]
+    fn split_commas_keeps_quoted_commas() {
+        let opts = FsOption::parse("context=\"system_u:object_r:tmp_t:s0:c1,c2\",nosuid")
+            .unwrap()
+            .split_commas()
+            .unwrap();
+        assert_eq!(opts.len(), 2);
+        assert_eq!(opts[0].key, "context");
+        assert_eq!(
+            opts[0].value.as_deref(),
+            Some("system_u:object_r:tmp_t:s0:c1,c2")
+        );
+        assert_eq!(opts[1].value, None);
+        // Quotes may cover any part of an item and are dropped
+        assert_eq!(split("x=a\"b,c\"d,e").unwrap(), ["x=ab,cd", "e"]);
+        assert_eq!(split("\"k=v,w\"").unwrap(), ["k=v,w"]);
+    }
+
+    #[test]
+    fn split_commas_keeps_empty_values_apart_from_flags() {
+        let opts = FsOption::parse("a=,b").unwrap().split_commas().unwrap();
+        assert_eq!(opts[0].value.as_deref(), Some(""));
+        assert_eq!(opts[1].value, None);
+    }
+
+    #[test]
+    fn split_commas_errors() {
+        assert_eq!(
+            split("a=\"b,c").unwrap_err(),
+            "unterminated quote in \"a=\\\"b,c\""
+        );
+        assert_eq!(split("a,=b").unwrap_err(), "empty option key in \"a,=b\"");
+    }
+
+    #[test]
+    fn split_commas_keeps_conditions_and_kind() {
+        let opts = FsOption::parse("@6.4 @ns a=1,b")
+            .unwrap()
+            .split_commas()
+            .unwrap();
+        assert_eq!(opts.len(), 2);
+        for opt in &opts {
+            assert_eq!(opt.min_kernel, Some(kernel(6, 4)));
+            assert_eq!(opt.in_namespace, Some(true));
+        }
+        // Only string values are split; a path is passed whole
+        let path = FsOption {
+            kind: ValueKind::Path,
+            ..FsOption::parse("dir=/a,b").unwrap()
+        };
+        let opts = path.split_commas().unwrap();
+        assert_eq!(opts.len(), 1);
+        assert_eq!(opts[0].value.as_deref(), Some("/a,b"));
+    }
+
+    #[test]
+    fn flag_empty_and_valued_forms() {
+        let flag = FsOption::parse("noswap").unwrap();
+        assert_eq!((flag.key.as_str(), flag.value.as_deref()), ("noswap", None));
+        assert_eq!(flag.to_string(), "noswap");
+        assert_eq!(flag.plan(), "FSCONFIG_SET_FLAG, \"noswap\"");
+
+        let empty = FsOption::parse("label=").unwrap();
+        assert_eq!(
+            (empty.key.as_str(), empty.value.as_deref()),
+            ("label", Some(""))
+        );
+        assert_eq!(empty.to_string(), "label=");
+        assert_eq!(empty.plan(), "FSCONFIG_SET_STRING, \"label\", \"\"");
+
+        let valued = FsOption::parse("size=1M").unwrap();
+        assert_eq!(
+            (valued.key.as_str(), valued.value.as_deref()),
+            ("size", Some("1M"))
+        );
+        assert_eq!(valued.to_string(), "size=1M");
+        assert_eq!(valued.plan(), "FSCONFIG_SET_STRING, \"size\", \"1M\"");
+    }
+}
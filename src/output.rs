@@ -0,0 +1,505 @@
+//! Reporting the outcome of a mount.
+
+use clap::ValueEnum;
+use rustix::io::Errno;
+use serde::Serialize;
+
+use crate::batch::Latency;
+use crate::error;
+use crate::statmount::MountStat;
+
+/// How the result of a successful mount is printed.
+#[derive(Clone, Copy, Debug, ValueEnum)]
+pub enum OutputFormat {
+    /// Only the details asked for with the --report-* flags, one per line
+    Plain,
+    /// An aligned table with a header row, like findmnt
+    Table,
+    /// One JSON object with every field and "success": true, for scripts;
+    /// errors are printed to stderr as {"success": false, "error": ...}
+    Json,
+}
+
+/// What was mounted where.
+#[derive(Serialize)]
+pub struct MountResult {
+    pub target: String,
+    /// The filesystem type, or "bind" for bind mounts.
+    pub fstype: String,
+    pub source: String,
+    /// Options that were actually applied, in order.
+    pub options: Vec<String>,
+    /// Names of the mount attributes the mount was created with.
+    pub attrs: Vec<&'static str>,
+    /// Inode of the mount namespace the mount was attached in.
+    pub mount_namespace: Option<u64>,
+    /// Whether the mount answered in time, if --wait-ready was given.
+    pub ready: Option<bool>,
+    pub mount: Option<MountNode>,
+    pub space: Option<Space>,
+    /// The namespaces involved, if --audit-namespaces was given.
+    pub audit: Option<Audit>,
+}
+
+/// The new mount's place in the mount tree.
+#[derive(Serialize)]
+pub struct MountNode {
+    pub id: u32,
+    pub parent_id: u32,
+    /// Propagation as in mountinfo, e.g. `shared:1`; empty when private.
+    pub propagation: Vec<String>,
+}
+
+impl MountNode {
+    fn propagation(&self) -> String {
+        if self.propagation.is_empty() {
+            "private".to_string()
+        } else {
+            self.propagation.join(" ")
+        }
+    }
+}
+
+/// Inodes of the namespaces a mount involved, for an audit trail.
+#[derive(Serialize)]
+pub struct Audit {
+    /// The mount namespace mic was started in.
+    pub caller_mnt: u64,
+    /// The user namespace mic was started in.
+    pub caller_user: u64,
+    /// The mount namespace the mount is attached in.
+    pub target_mnt: u64,
+}
+
+impl Audit {
+    /// The line logged to stderr before the mount is attached.
+    pub fn line(&self) -> String {
+        format!(
+            "audit: caller mnt:[{}] user:[{}], target mnt:[{}]",
+            self.caller_mnt, self.caller_user, self.target_mnt
+        )
+    }
+}
+
+/// Size of a mounted filesystem in bytes.
+#[derive(Serialize)]
+pub struct Space {
+    pub total: u64,
+    pub free: u64,
+    /// Free space usable by unprivileged users.
+    pub available: u64,
+}
+
+impl Space {
+    // The statfs field types are narrower on some 32-bit targets
+    #[allow(clippy::unnecessary_cast)]
+    pub fn from_statfs(st: &rustix::fs::StatFs) -> Space {
+        // Block counts are in units of the fragment size, which older
+        // kernels leave zero because it equals the block size there.
+        let frsize = if st.f_frsize > 0 {
+            st.f_frsize
+        } else {
+            st.f_bsize
+        } as u64;
+        Space {
+            total: st.f_blocks as u64 * frsize,
+            free: st.f_bfree as u64 * frsize,
+            available: st.f_bavail as u64 * frsize,
+        }
+    }
+}
+
+impl MountResult {
+    pub fn render(&self, format: OutputFormat) -> String {
+        match format {
+            OutputFormat::Plain => self.plain(),
+            OutputFormat::Table => self.table(),
+            OutputFormat::Json => self.json(),
+        }
+    }
+
+    fn json(&self) -> String {
+        #[derive(Serialize)]
+        struct Success<'a> {
+            success: bool,
+            #[serde(flatten)]
+            result: &'a MountResult,
+        }
+        let out = Success {
+            success: true,
+            result: self,
+        };
+        // Only strings, numbers and lists, which always serialize
+        format!("{}\n", serde_json::to_string(&out).unwrap_or_default())
+    }
+
+    fn plain(&self) -> String {
+        let mut out = String::new();
+        if let Some(ino) = self.mount_namespace {
+            out.push_str(&format!("mount namespace: mnt:[{}]\n", ino));
+        }
+        if let Some(ready) = self.ready {
+            out.push_str(&format!("ready: {}\n", yes_no(ready)));
+        }
+        if let Some(mount) = &self.mount {
+            out.push_str(&format!(
+                "mount id: {}, parent id: {}, propagation: {}\n",
+                mount.id,
+                mount.parent_id,
+                mount.propagation()
+            ));
+        }
+        if let Some(space) = &self.space {
+            out.push_str(&format!(
+                "space: {} bytes total, {} free, {} available\n",
+                space.total, space.free, space.available
+            ));
+        }
+        out
+    }
+
+    fn table(&self) -> String {
+        let or_dash = |s: String| if s.is_empty() { "-".to_string() } else { s };
+        let mut header = vec!["TARGET", "TYPE", "SOURCE", "OPTIONS", "ATTRS"];
+        let mut row = vec![
+            self.target.clone(),
+            self.fstype.clone(),
+            or_dash(self.source.clone()),
+            or_dash(self.options.join(",")),
+            or_dash(self.attrs.join(",")),
+        ];
+        if let Some(ino) = self.mount_namespace {
+            header.push("NAMESPACE");
+            row.push(format!("mnt:[{}]", ino));
+        }
+        if let Some(ready) = self.ready {
+            header.push("READY");
+            row.push(yes_no(ready).to_string());
+        }
+        if let Some(mount) = &self.mount {
+            header.extend(["ID", "PARENT", "PROPAGATION"]);
+            row.extend([
+                mount.id.to_string(),
+                mount.parent_id.to_string(),
+                mount.propagation(),
+            ]);
+        }
+        if let Some(space) = &self.space {
+            header.extend(["SIZE", "FREE", "AVAIL"]);
+            row.extend([space.total, space.free, space.available].map(|n| n.to_string()));
+        }
+        let header = header.into_iter().map(str::to_string).collect();
+        render_table(&[header, row])
+    }
+}
+
+/// What a --config run mounted, printed once every entry is mounted.
+#[derive(Serialize)]
+pub struct BatchSummary {
+    /// Number of entries mounted.
+    pub mounted: usize,
+    /// How long the entries took to mount, each from starting mic for it
+    /// to its exit.
+    pub latency: Option<Latency>,
+}
+
+impl BatchSummary {
+    pub fn render(&self, format: OutputFormat) -> String {
+        match format {
+            OutputFormat::Json => {
+                #[derive(Serialize)]
+                struct Success<'a> {
+                    success: bool,
+                    #[serde(flatten)]
+                    summary: &'a BatchSummary,
+                }
+                let out = Success {
+                    success: true,
+                    summary: self,
+                };
+                // Only numbers, which always serialize
+                format!("{}\n", serde_json::to_string(&out).unwrap_or_default())
+            }
+            OutputFormat::Plain | OutputFormat::Table => match &self.latency {
+                Some(l) => format!(
+                    "mounted {} entries in min {:.1}ms, p50 {:.1}ms, p95 {:.1}ms, max {:.1}ms\n",
+                    self.mounted, l.min_ms, l.p50_ms, l.p95_ms, l.max_ms
+                ),
+                None => format!("mounted {} entries\n", self.mounted),
+            },
+        }
+    }
+}
+
+/// Renders what --stat found out about a mount.
+pub fn render_stat(stat: &MountStat, format: OutputFormat) -> String {
+    let or_dash = |s: String| if s.is_empty() { "-".to_string() } else { s };
+    let propagation = if stat.propagation.is_empty() {
+        "private".to_string()
+    } else {
+        stat.propagation.join(" ")
+    };
+    let submounts: Vec<String> = stat.submounts.iter().map(u64::to_string).collect();
+    let fields = [
+        ("ID", stat.id.to_string()),
+        ("PARENT", stat.parent_id.to_string()),
+        ("TARGET", stat.mount_point.clone()),
+        ("TYPE", stat.fstype.clone()),
+        ("PROPAGATION", propagation),
+        ("ATTRS", or_dash(stat.attrs.join(","))),
+        ("OPTIONS", or_dash(stat.options.clone())),
+        ("SUBMOUNTS", or_dash(submounts.join(","))),
+    ];
+    match format {
+        OutputFormat::Plain => fields
+            .iter()
+            .map(|(name, value)| format!("{}: {}\n", name.to_lowercase(), value))
+            .collect(),
+        OutputFormat::Table => {
+            let (header, row) = fields
+                .into_iter()
+                .map(|(name, value)| (name.to_string(), value))
+                .unzip();
+            render_table(&[header, row])
+        }
+        OutputFormat::Json => {
+            #[derive(Serialize)]
+            struct Success<'a> {
+                success: bool,
+                #[serde(flatten)]
+                stat: &'a MountStat,
+            }
+            let out = Success {
+                success: true,
+                stat,
+            };
+            // Only strings, numbers and lists, which always serialize
+            format!("{}\n", serde_json::to_string(&out).unwrap_or_default())
+        }
+    }
+}
+
+/// Renders an error message as the JSON object printed for --output json,
+/// with the errno it came from as a number and by name, both null for a
+/// failure that was not a failed syscall.
+pub fn error_json(msg: &str, errno: Option<Errno>) -> String {
+    serde_json::json!({
+        "success": false,
+        "error": msg,
+        "errno": errno.map(Errno::raw_os_error),
+        "errno_name": errno.and_then(error::errno_name),
+    })
+    .to_string()
+}
+
+fn yes_no(b: bool) -> &'static str {
+    if b {
+        "yes"
+    } else {
+        "no"
+    }
+}
+
+/// Lays out rows as columns separated by two spaces, padding every column
+/// but the last to its widest cell.
+pub fn render_table(rows: &[Vec<String>]) -> String {
+    let columns = rows.iter().map(Vec::len).max().unwrap_or(0);
+    let widths: Vec<usize> = (0..columns)
+        .map(|col| {
+            rows.iter()
+                .filter_map(|row| row.get(col))
+                .map(|cell| cell.chars().count())
+                .max()
+                .unwrap_or(0)
+        })
+        .collect();
+    let mut out = String::new();
+    for row in rows {
+        let mut line = String::new();
+        for (col, cell) in row.iter().enumerate() {
+            if col + 1 == row.len() {
+                line.push_str(cell);
+            } else {
+                line.push_str(&format!("{:<width$}  ", cell, width = widths[col]));
+            }
+        }
+        out.push_str(line.trim_end());
+        out.push('\n');
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn statfs(bsize: i64, frsize: i64, blocks: u64, bfree: u64, bavail: u64) -> rustix::fs::StatFs {
+        // Plain C struct, all zeroes is a valid value
+        let mut st: rustix::fs::StatFs = unsafe { std::mem::zeroed() };
+        st.f_bsize = bsize as _;
+        st.f_frsize = frsize as _;
+        st.f_blocks = blocks as _;
+        st.f_bfree = bfree as _;
+        st.f_bavail = bavail as _;
+        st
+    }
+
+    fn result() -> MountResult {
+        MountResult {
+            target: "/mnt".to_string(),
+            fstype: "tmpfs".to_string(),
+            source: String::new(),
+            options: vec!["size=1M".to_string()],
+            attrs: vec!["nosuid"],
+            mount_namespace: None,
+            ready: None,
+            mount: None,
+            space: None,
+            audit: None,
+        }
+    }
+
+    #[test]
+    fn space_counts_fragments() {
+        let space = Space::from_statfs(&statfs(4096, 1024, 100, 40, 30));
+        assert_eq!(
+            (space.total, space.free, space.available),
+            (102400, 40960, 30720)
+        );
+        // Without a fragment size the block size is used
+        let space = Space::from_statfs(&statfs(4096, 0, 100, 40, 30));
+        assert_eq!(
+            (space.total, space.free, space.available),
+            (409600, 163840, 122880)
+        );
+    }
+
+    #[test]
+    fn space_is_reported_in_every_format() {
+        let mut res = result();
+        assert_eq!(res.render(OutputFormat::Plain), "");
+        res.space = Some(Space::from_statfs(&statfs(4096, 4096, 256, 250, 250)));
+        assert_eq!(
+            res.render(OutputFormat::Plain),
+            "space: 1048576 bytes total, 1024000 free, 1024000 available\n"
+        );
+        assert!(res
+            .render(OutputFormat::Json)
+            .contains(r#""space":{"total":1048576,"free":1024000,"available":1024000}"#));
+        let table = res.render(OutputFormat::Table);
+        let header = table.lines().next().unwrap();
+        assert!(header.ends_with("SIZE     FREE     AVAIL"), "{}", header);
+    }
+
+    #[test]
+    fn table_pads_all_but_the_last_column() {
+        let rows = [
+            vec!["A".to_string(), "LONGER".to_string(), "C".to_string()],
+            vec!["wide cell".to_string(), "x".to_string(), "last".to_string()],
+        ];
+        assert_eq!(
+            render_table(&rows),
+            "A          LONGER  C\nwide cell  x       last\n"
+        );
+    }
+
+    #[test]
+    fn table_shows_optional_columns_when_set() {
+        let mut res = result();
+        assert_eq!(
+            res.render(OutputFormat::Table),
+            "TARGET  TYPE   SOURCE  OPTIONS  ATTRS\n/mnt    tmpfs  -       size=1M  nosuid\n"
+        );
+        res.mount_namespace = Some(4026531841);
+        res.ready = Some(true);
+        res.mount = Some(MountNode {
+            id: 42,
+            parent_id: 1,
+            propagation: Vec::new(),
+        });
+        let table = res.render(OutputFormat::Table);
+        let lines: Vec<&str> = table.lines().collect();
+        assert_eq!(
+            lines[0].split_whitespace().collect::<Vec<_>>(),
+            [
+                "TARGET",
+                "TYPE",
+                "SOURCE",
+                "OPTIONS",
+                "ATTRS",
+                "NAMESPACE",
+                "READY",
+                "ID",
+                "PARENT",
+                "PROPAGATION"
+            ]
+        );
+        assert_eq!(
+            lines[1].split_whitespace().collect::<Vec<_>>(),
+            [
+                "/mnt",
+                "tmpfs",
+                "-",
+                "size=1M",
+                "nosuid",
+                "mnt:[4026531841]",
+                "yes",
+                "42",
+                "1",
+                "private"
+            ]
+        );
+    }
+
+    #[test]
+    fn mount_namespace_is_reported() {
+        let mut res = result();
+        assert!(res
+            .render(OutputFormat::Json)
+            .contains(r#""mount_namespace":null"#));
+        assert!(!res.render(OutputFormat::Plain).contains("mount namespace"));
+        res.mount_namespace = Some(4026532300);
+        assert!(res
+            .render(OutputFormat::Json)
+            .contains(r#""mount_namespace":4026532300"#));
+        assert!(res
+            .render(OutputFormat::Plain)
+            .contains("mount namespace: mnt:[4026532300]\n"));
+    }
+
+    #[test]
+    fn audit_is_logged_and_in_json() {
+        let audit = Audit {
+            caller_mnt: 4026531841,
+            caller_user: 4026531837,
+            target_mnt: 4026532300,
+        };
+        assert_eq!(
+            audit.line(),
+            "audit: caller mnt:[4026531841] user:[4026531837], target mnt:[4026532300]"
+        );
+        let mut res = result();
+        assert!(res.render(OutputFormat::Json).contains(r#""audit":null"#));
+        res.audit = Some(audit);
+        assert!(res.render(OutputFormat::Json).contains(
+            r#""audit":{"caller_mnt":4026531841,"caller_user":4026531837,"target_mnt":4026532300}"#
+        ));
+    }
+
+    #[test]
+    fn error_json_carries_the_errno() {
+        assert_eq!(
+            error_json("target missing", None),
+            r#"{"errno":null,"errno_name":null,"error":"target missing","success":false}"#
+        );
+        assert_eq!(
+            error_json("fsconfig failed", Some(Errno::INVAL)),
+            r#"{"errno":22,"errno_name":"EINVAL","error":"fsconfig failed","success":false}"#
+        );
+        // An errno without a known name still has its number
+        assert_eq!(
+            error_json("failed", Some(Errno::from_raw_os_error(4095))),
+            r#"{"errno":4095,"errno_name":null,"error":"failed","success":false}"#
+        );
+    }
+}
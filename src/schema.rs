@@ -0,0 +1,140 @@
+//! A JSON Schema for the configuration printed by --dump-config.
+
+use serde_json::{json, Value};
+
+use crate::attrs;
+
+/// Returns a JSON Schema (draft 2020-12) describing Config as serialized,
+/// so tools can check a configuration before handing it to mic. It is
+/// written out by hand and has to be kept in step with Config and FsOption.
+pub fn config_schema() -> Value {
+    let string = json!({ "type": "string" });
+    let flag = json!({ "type": "boolean" });
+    let strings = json!({ "type": "array", "items": { "type": "string" } });
+    let nullable = |ty: &str| json!({ "type": [ty, "null"] });
+    let propagation = json!({ "enum": ["private", "shared", "slave", "unbindable", null] });
+    json!({
+        "$schema": "https://json-schema.org/draft/2020-12/schema",
+        "title": "mic config",
+        "type": "object",
+        "additionalProperties": false,
+        "required": ["target", "fstype", "options", "attrs"],
+        "properties": {
+            "target": string,
+            "source": string,
+            "fstype": nullable("string"),
+            "options": { "type": "array", "items": option_schema() },
+            "max_options": { "type": ["integer", "null"], "minimum": 0 },
+            "max_option_len": { "type": "integer", "minimum": 0 },
+            "continue_on_option_error": flag,
+            "ignore_option_errors": flag,
+            "source_last": flag,
+            "source_fd": flag,
+            "attrs": {
+                "type": "array",
+                "items": { "enum": attrs::known_names() },
+                "uniqueItems": true
+            },
+            "relax_attrs": flag,
+            "userns": nullable("string"),
+            "verify_magic": flag,
+            "warn_overmount": flag,
+            "force_create": flag,
+            "strict": flag,
+            "private_parent": flag,
+            "wait_ready": {
+                "description": "Duration such as 5s or 500ms",
+                "type": ["string", "null"]
+            },
+            "teardown_on_not_ready": flag,
+            "recursive": flag,
+            "allow_file_target": flag,
+            "clone_from": flag,
+            "mkdir_retries": { "type": "integer", "minimum": 0 },
+            "mkdir_umask": flag,
+            "mkdir": flag,
+            "mode": { "type": "integer", "minimum": 0, "maximum": 4095 },
+            "require_owner": { "type": ["integer", "null"], "minimum": 0 },
+            "validate": flag,
+            "proc_path": string,
+            "mount_namespace": string,
+            "user_namespace": nullable("string"),
+            "net_namespace": nullable("string"),
+            "new_namespace": flag,
+            "isolate": flag,
+            "also_at": strings,
+            "send_context": nullable("string"),
+            "recv_context": nullable("string"),
+            "then_ro": flag,
+            "fuse": flag,
+            "fuse_socket": nullable("string"),
+            "post_mount_exec": strings,
+            "propagation": propagation
+        }
+    })
+}
+
+/// Schema of one serialized FsOption.
+fn option_schema() -> Value {
+    json!({
+        "type": "object",
+        "additionalProperties": false,
+        "required": ["key"],
+        "properties": {
+            "key": { "type": "string", "minLength": 1 },
+            "value": {
+                "description": "null for a flag set with FSCONFIG_SET_FLAG",
+                "type": ["string", "null"]
+            },
+            "min_kernel": {
+                "description": "Only applied on kernels at least this new, e.g. 6.4",
+                "type": ["string", "null"],
+                "pattern": "^[0-9]+\\.[0-9]+$"
+            },
+            "in_namespace": {
+                "description": "true for @ns, false for @no-ns",
+                "type": ["boolean", "null"]
+            },
+            "kind": {
+                "description": "How value is passed; absent for string and flag options",
+                "enum": ["binary", "path", "path_empty", "fd", "dir_fd"]
+            }
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn schema_is_json_with_the_config_properties() {
+        let text = serde_json::to_string_pretty(&config_schema()).unwrap();
+        let schema: Value = serde_json::from_str(&text).unwrap();
+        assert_eq!(
+            schema["$schema"],
+            "https://json-schema.org/draft/2020-12/schema"
+        );
+        assert_eq!(schema["type"], "object");
+        let properties = schema["properties"].as_object().unwrap();
+        for key in [
+            "target",
+            "source",
+            "fstype",
+            "options",
+            "attrs",
+            "mount_namespace",
+        ] {
+            assert!(properties.contains_key(key), "{}", key);
+        }
+        for key in schema["required"].as_array().unwrap() {
+            assert!(properties.contains_key(key.as_str().unwrap()), "{}", key);
+        }
+        let option = &properties["options"]["items"];
+        assert_eq!(option["required"], json!(["key"]));
+        assert!(properties["attrs"]["items"]["enum"]
+            .as_array()
+            .unwrap()
+            .contains(&json!("nosuid")));
+    }
+}
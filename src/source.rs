@@ -0,0 +1,103 @@
+//! Resolving --source values that name block devices indirectly.
+
+use std::path::Path;
+
+const MAPPER_DIR: &str = "/dev/mapper";
+
+/// Maps LVM `vg/lv` shorthand to its device-mapper node, e.g. `vg0/data` to
+/// `/dev/mapper/vg0-data`, and checks that the node exists. A source that
+/// exists as given, such as a relative path to an image, is not taken as
+/// shorthand. Sources that are not in that form, other than `/dev/mapper/`
+/// paths which are checked too, are returned unchanged.
+pub fn resolve(source: &str) -> Result<String, String> {
+    resolve_with(source, |path| path.exists())
+}
+
+/// The work of resolve, with the existence check passed in.
+fn resolve_with(source: &str, exists: impl Fn(&Path) -> bool) -> Result<String, String> {
+    let path = match dm_name(source) {
+        Some(_) if exists(Path::new(source)) => return Ok(source.to_string()),
+        Some(name) => format!("{}/{}", MAPPER_DIR, name),
+        None if source.starts_with("/dev/mapper/") => source.to_string(),
+        None => return Ok(source.to_string()),
+    };
+    if !exists(Path::new(&path)) {
+        return Err(format!(
+            "device-mapper node {} for source {} does not exist",
+            path, source
+        ));
+    }
+    Ok(path)
+}
+
+/// Returns the device-mapper name for `vg/lv`, or None if source is not a
+/// volume group and logical volume name separated by a single slash.
+fn dm_name(source: &str) -> Option<String> {
+    let (vg, lv) = source.split_once('/')?;
+    if !is_lvm_name(vg) || !is_lvm_name(lv) {
+        return None;
+    }
+    // LVM doubles hyphens inside each name so the separator stays unambiguous
+    Some(format!(
+        "{}-{}",
+        vg.replace('-', "--"),
+        lv.replace('-', "--")
+    ))
+}
+
+/// Reports whether s is a valid LVM volume group or logical volume name.
+fn is_lvm_name(s: &str) -> bool {
+    !s.is_empty()
+        && !s.starts_with('-')
+        && s != "."
+        && s != ".."
+        && s.chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '+' | '_' | '.' | '-'))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn resolve_among(source: &str, existing: &[&str]) -> Result<String, String> {
+        resolve_with(source, |path| existing.iter().any(|e| Path::new(e) == path))
+    }
+
+    #[test]
+    fn shorthand_maps_to_mapper_node() {
+        assert_eq!(
+            resolve_among("vg0/data", &["/dev/mapper/vg0-data"]).unwrap(),
+            "/dev/mapper/vg0-data"
+        );
+        assert_eq!(
+            resolve_among("my-vg/lv-1", &["/dev/mapper/my--vg-lv--1"]).unwrap(),
+            "/dev/mapper/my--vg-lv--1"
+        );
+        assert_eq!(
+            resolve_among("vg0/data", &[]).unwrap_err(),
+            "device-mapper node /dev/mapper/vg0-data for source vg0/data does not exist"
+        );
+    }
+
+    #[test]
+    fn existing_path_is_not_shorthand() {
+        // e.g. a relative path to an image file
+        assert_eq!(
+            resolve_among(
+                "images/disk.img",
+                &["images/disk.img", "/dev/mapper/images-disk.img"]
+            )
+            .unwrap(),
+            "images/disk.img"
+        );
+    }
+
+    #[test]
+    fn other_sources_are_left_alone() {
+        assert_eq!(resolve_among("/dev/sda1", &[]).unwrap(), "/dev/sda1");
+        assert_eq!(resolve_among("none", &[]).unwrap(), "none");
+        assert_eq!(resolve_among("a/b/c", &[]).unwrap(), "a/b/c");
+        assert_eq!(resolve_among("-vg/lv", &[]).unwrap(), "-vg/lv");
+        assert!(resolve_among("/dev/mapper/gone", &[]).is_err());
+    }
+}
@@ -0,0 +1,294 @@
+//! Looking up a mount with statmount(2) and listmount(2), which neither
+//! rustix nor libc wrap yet, or from mountinfo on kernels without them.
+
+use rustix::fs::{statx, AtFlags, StatxFlags};
+use rustix::io::Errno;
+use rustix::mount::MountAttrFlags;
+use serde::Serialize;
+use std::path::Path;
+
+use crate::attrs;
+use crate::mountinfo::{self, MountInfo};
+use crate::sys::retry_eintr;
+
+/// Syscall numbers, the same on every architecture since Linux 6.8.
+const SYS_STATMOUNT: libc::c_long = 457;
+const SYS_LISTMOUNT: libc::c_long = 458;
+
+/// statx mask bit for the 64-bit mount ID statmount and listmount take.
+const STATX_MNT_ID_UNIQUE: u32 = 0x4000;
+
+/// statmount request mask bits.
+const STATMOUNT_SB_BASIC: u64 = 0x1;
+const STATMOUNT_MNT_BASIC: u64 = 0x2;
+const STATMOUNT_PROPAGATE_FROM: u64 = 0x4;
+const STATMOUNT_MNT_POINT: u64 = 0x10;
+const STATMOUNT_FS_TYPE: u64 = 0x20;
+const STATMOUNT_MNT_OPTS: u64 = 0x80;
+
+/// Propagation types in statmount's mnt_propagation.
+const MS_UNBINDABLE: u64 = 1 << 17;
+const MS_SLAVE: u64 = 1 << 19;
+const MS_SHARED: u64 = 1 << 20;
+
+/// struct mnt_id_req as of Linux 6.8 (MNT_ID_REQ_SIZE_VER0).
+#[repr(C)]
+struct MntIdReq {
+    size: u32,
+    spare: u32,
+    mnt_id: u64,
+    param: u64,
+}
+
+/// The fixed part of struct statmount, up to the fields mic reads. The
+/// string fields are offsets into the string area that follows the
+/// 512-byte header, valid when their bit is set in mask.
+#[repr(C)]
+#[derive(Clone, Copy, Debug)]
+pub struct Statmount {
+    pub size: u32,
+    pub mnt_opts: u32,
+    pub mask: u64,
+    pub sb_dev_major: u32,
+    pub sb_dev_minor: u32,
+    pub sb_magic: u64,
+    pub sb_flags: u32,
+    pub fs_type: u32,
+    pub mnt_id: u64,
+    pub mnt_parent_id: u64,
+    pub mnt_id_old: u32,
+    pub mnt_parent_id_old: u32,
+    pub mnt_attr: u64,
+    pub mnt_propagation: u64,
+    pub mnt_peer_group: u64,
+    pub mnt_master: u64,
+    pub propagate_from: u64,
+    pub mnt_root: u32,
+    pub mnt_point: u32,
+}
+
+/// Size of struct statmount before its string area.
+const STATMOUNT_HEADER_LEN: usize = 512;
+
+/// What mic reports about a mount for --stat.
+#[derive(Clone, Debug, Serialize)]
+pub struct MountStat {
+    /// The 64-bit mount ID from statmount, or the reusable one from
+    /// mountinfo.
+    pub id: u64,
+    pub parent_id: u64,
+    pub mount_point: String,
+    pub fstype: String,
+    /// Propagation as in mountinfo, e.g. `shared:1` or `master:2`; empty
+    /// when private.
+    pub propagation: Vec<String>,
+    /// Names of the per-mount attributes, as --attrs takes them.
+    pub attrs: Vec<&'static str>,
+    /// The filesystem's own options, e.g. `size=65536k,mode=755`; empty if
+    /// the kernel does not report them.
+    pub options: String,
+    /// IDs of every mount below this one, however deep.
+    pub submounts: Vec<u64>,
+    /// "statmount" or "mountinfo", whichever the details came from.
+    pub via: &'static str,
+}
+
+/// Describes the topmost mount at path, with statmount and listmount if
+/// the kernel has them and from the mountinfo file at mountinfo_path if not.
+pub fn stat(path: &Path, mountinfo_path: &Path) -> Result<MountStat, String> {
+    match stat_statmount(path) {
+        Ok(stat) => Ok(stat),
+        Err(Errno::NOSYS) | Err(Errno::INVAL) => stat_mountinfo(path, mountinfo_path),
+        Err(e) => Err(format!("statmount {} failed: {}", path.display(), e)),
+    }
+}
+
+/// Returns the 64-bit mount ID of the mount path is on. Fails with EINVAL
+/// on kernels older than 6.8, which do not know the request.
+pub fn unique_mount_id(path: &Path) -> rustix::io::Result<u64> {
+    let st = statx(
+        rustix::fs::CWD,
+        path,
+        AtFlags::empty(),
+        StatxFlags::from_bits_retain(STATX_MNT_ID_UNIQUE),
+    )?;
+    if st.stx_mask & STATX_MNT_ID_UNIQUE == 0 {
+        return Err(Errno::INVAL);
+    }
+    Ok(st.stx_mnt_id)
+}
+
+/// Calls statmount for the mount with the 64-bit ID mnt_id, requesting
+/// mask, and returns the header and its string area.
+pub fn statmount(mnt_id: u64, mask: u64) -> rustix::io::Result<(Statmount, Vec<u8>)> {
+    let req = MntIdReq {
+        size: std::mem::size_of::<MntIdReq>() as u32,
+        spare: 0,
+        mnt_id,
+        param: mask,
+    };
+    let mut buf = vec![0u64; 512];
+    loop {
+        let len = buf.len() * 8;
+        let res = retry_eintr(|| {
+            // SAFETY: req is a valid mnt_id_req and buf is a writable,
+            // 8-byte aligned buffer of len bytes; both outlive the call.
+            let ret = unsafe {
+                libc::syscall(
+                    SYS_STATMOUNT,
+                    &req as *const MntIdReq,
+                    buf.as_mut_ptr(),
+                    len,
+                    0,
+                )
+            };
+            if ret < 0 {
+                return Err(last_errno());
+            }
+            Ok(())
+        });
+        match res {
+            Ok(()) => break,
+            // The strings did not fit
+            Err(Errno::OVERFLOW) => buf.resize(buf.len() * 2, 0),
+            Err(e) => return Err(e),
+        }
+    }
+    let bytes: Vec<u8> = buf.iter().flat_map(|w| w.to_ne_bytes()).collect();
+    // SAFETY: bytes holds at least STATMOUNT_HEADER_LEN bytes written by
+    // the kernel, and Statmount is plain integers.
+    let header = unsafe { std::ptr::read_unaligned(bytes.as_ptr() as *const Statmount) };
+    let strings = bytes[STATMOUNT_HEADER_LEN..].to_vec();
+    Ok((header, strings))
+}
+
+/// Returns the 64-bit IDs of all the mounts below the mount mnt_id, at any
+/// depth.
+pub fn listmount(mnt_id: u64) -> rustix::io::Result<Vec<u64>> {
+    let mut ids = Vec::new();
+    let mut last = 0;
+    loop {
+        let req = MntIdReq {
+            size: std::mem::size_of::<MntIdReq>() as u32,
+            spare: 0,
+            mnt_id,
+            param: last,
+        };
+        let mut batch = [0u64; 256];
+        let n = retry_eintr(|| {
+            // SAFETY: req is a valid mnt_id_req and batch has room for the
+            // number of IDs passed; both outlive the call.
+            let ret = unsafe {
+                libc::syscall(
+                    SYS_LISTMOUNT,
+                    &req as *const MntIdReq,
+                    batch.as_mut_ptr(),
+                    batch.len(),
+                    0,
+                )
+            };
+            if ret < 0 {
+                return Err(last_errno());
+            }
+            Ok(ret as usize)
+        })?;
+        ids.extend_from_slice(&batch[..n]);
+        if n < batch.len() {
+            return Ok(ids);
+        }
+        // Continue after the last ID returned
+        last = batch[n - 1];
+    }
+}
+
+fn stat_statmount(path: &Path) -> rustix::io::Result<MountStat> {
+    let mnt_id = unique_mount_id(path)?;
+    let mask = STATMOUNT_SB_BASIC
+        | STATMOUNT_MNT_BASIC
+        | STATMOUNT_PROPAGATE_FROM
+        | STATMOUNT_MNT_POINT
+        | STATMOUNT_FS_TYPE
+        | STATMOUNT_MNT_OPTS;
+    let (sm, strings) = statmount(mnt_id, mask)?;
+    let string = |bit: u64, offset: u32| {
+        if sm.mask & bit == 0 {
+            return String::new();
+        }
+        let s = strings.get(offset as usize..).unwrap_or_default();
+        let end = s.iter().position(|&b| b == 0).unwrap_or(s.len());
+        String::from_utf8_lossy(&s[..end]).into_owned()
+    };
+    let mut propagation = Vec::new();
+    if sm.mnt_propagation & MS_SHARED != 0 {
+        propagation.push(format!("shared:{}", sm.mnt_peer_group));
+    }
+    if sm.mnt_propagation & MS_SLAVE != 0 {
+        propagation.push(format!("master:{}", sm.mnt_master));
+        if sm.mask & STATMOUNT_PROPAGATE_FROM != 0 && sm.propagate_from != 0 {
+            propagation.push(format!("propagate_from:{}", sm.propagate_from));
+        }
+    }
+    if sm.mnt_propagation & MS_UNBINDABLE != 0 {
+        propagation.push("unbindable".to_string());
+    }
+    Ok(MountStat {
+        id: sm.mnt_id,
+        parent_id: sm.mnt_parent_id,
+        mount_point: string(STATMOUNT_MNT_POINT, sm.mnt_point),
+        fstype: string(STATMOUNT_FS_TYPE, sm.fs_type),
+        propagation,
+        attrs: attrs::attr_names(MountAttrFlags::from_bits_truncate(sm.mnt_attr as u32)),
+        options: string(STATMOUNT_MNT_OPTS, sm.mnt_opts),
+        submounts: listmount(mnt_id)?,
+        via: "statmount",
+    })
+}
+
+fn stat_mountinfo(path: &Path, mountinfo_path: &Path) -> Result<MountStat, String> {
+    let mounts = mountinfo::read(mountinfo_path)?;
+    let resolved = std::fs::canonicalize(path)
+        .map_err(|e| format!("resolve {} failed: {}", path.display(), e))?;
+    let Some(top) = mountinfo::mounts_at(&mounts, &resolved).pop() else {
+        return Err(format!("{} is not a mountpoint", path.display()));
+    };
+    // Per-mount options as --attrs names them; rw is the absence of ro
+    let names: Vec<&str> = top
+        .mount_options
+        .split(',')
+        .filter(|name| *name != "rw")
+        .collect();
+    let flags = attrs::parse_attrs(&names.join(",")).unwrap_or(MountAttrFlags::empty());
+    Ok(MountStat {
+        id: top.mount_id.into(),
+        parent_id: top.parent_id.into(),
+        mount_point: top.mount_point.clone(),
+        fstype: top.fstype.clone(),
+        propagation: top.propagation.clone(),
+        attrs: attrs::attr_names(flags),
+        // statmount leaves out the superblock's ro/rw, so drop it here too
+        options: top
+            .super_options
+            .split(',')
+            .filter(|opt| *opt != "rw" && *opt != "ro")
+            .collect::<Vec<_>>()
+            .join(","),
+        submounts: submounts(&mounts, top),
+        via: "mountinfo",
+    })
+}
+
+/// Returns the IDs of the mounts below top, as listmount would. Parents come
+/// before their children in mountinfo, so one pass finds them all.
+fn submounts(mounts: &[MountInfo], top: &MountInfo) -> Vec<u64> {
+    let mut below = vec![top.mount_id];
+    for m in mounts {
+        if m.mount_id != m.parent_id && below.contains(&m.parent_id) {
+            below.push(m.mount_id);
+        }
+    }
+    below[1..].iter().map(|&id| id.into()).collect()
+}
+
+fn last_errno() -> Errno {
+    Errno::from_io_error(&std::io::Error::last_os_error()).unwrap_or(Errno::IO)
+}
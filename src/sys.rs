@@ -0,0 +1,146 @@
+//! Thin helpers around the mount syscalls.
+
+use rustix::io::Errno;
+use rustix::mount::{move_mount, open_tree, MountAttrFlags, MoveMountFlags, OpenTreeFlags};
+use std::ffi::{CStr, CString};
+use std::os::fd::{AsRawFd, BorrowedFd, OwnedFd};
+use std::os::unix::ffi::OsStrExt;
+use std::path::Path;
+
+/// Calls f until it fails with something other than EINTR, so that a signal
+/// arriving during a slow syscall does not fail the whole mount.
+pub fn retry_eintr<T>(mut f: impl FnMut() -> rustix::io::Result<T>) -> rustix::io::Result<T> {
+    loop {
+        match f() {
+            Err(Errno::INTR) => continue,
+            res => return res,
+        }
+    }
+}
+
+/// Returns a detached clone of the mount at path, ready to be attached
+/// elsewhere as a bind mount. With recursive the mounts below path are
+/// cloned too, like mount --rbind; without, only the one path is on.
+pub fn clone_tree(path: &Path, recursive: bool) -> rustix::io::Result<OwnedFd> {
+    let mut flags = OpenTreeFlags::OPEN_TREE_CLONE | OpenTreeFlags::OPEN_TREE_CLOEXEC;
+    flags.set(OpenTreeFlags::AT_RECURSIVE, recursive);
+    retry_eintr(|| open_tree(rustix::fs::CWD, path, flags))
+}
+
+/// Returns a detached clone of the mount mnt_fd refers to, e.g. one from
+/// fsmount that has been attached since, without the mounts below it.
+pub fn clone_mount(mnt_fd: BorrowedFd<'_>) -> rustix::io::Result<OwnedFd> {
+    let flags = OpenTreeFlags::OPEN_TREE_CLONE
+        | OpenTreeFlags::OPEN_TREE_CLOEXEC
+        | OpenTreeFlags::AT_EMPTY_PATH;
+    retry_eintr(|| open_tree(mnt_fd, "", flags))
+}
+
+/// Attaches a detached mount from fsmount or open_tree at target in the
+/// current mount namespace.
+pub fn attach(mnt_fd: BorrowedFd<'_>, target: &Path) -> rustix::io::Result<()> {
+    retry_eintr(|| {
+        move_mount(
+            mnt_fd,
+            "",
+            rustix::fs::CWD,
+            target,
+            MoveMountFlags::MOVE_MOUNT_F_EMPTY_PATH,
+        )
+    })
+}
+
+/// Sets and clears attributes on the existing mount at path with
+/// mount_setattr, which rustix does not wrap. With recursive the change
+/// applies to every mount below path as well.
+pub fn mount_setattr(
+    path: &Path,
+    set: MountAttrFlags,
+    clear: MountAttrFlags,
+    recursive: bool,
+) -> rustix::io::Result<()> {
+    let path = CString::new(path.as_os_str().as_bytes()).map_err(|_| Errno::INVAL)?;
+    let flags = if recursive { libc::AT_RECURSIVE } else { 0 };
+    let mut attr = libc::mount_attr {
+        attr_set: set.bits() as u64,
+        attr_clr: clear.bits() as u64,
+        propagation: 0,
+        userns_fd: 0,
+    };
+    raw_mount_setattr(libc::AT_FDCWD, &path, flags, &mut attr)
+}
+
+/// Makes the detached mount mnt_fd an idmapped mount that maps ids through
+/// the user namespace userns, e.g. an fd of /proc/<pid>/ns/user. This must
+/// happen before the mount is attached. With recursive it applies to every
+/// mount in a recursive clone as well.
+pub fn set_idmap(
+    mnt_fd: BorrowedFd<'_>,
+    userns: BorrowedFd<'_>,
+    recursive: bool,
+) -> rustix::io::Result<()> {
+    let mut flags = libc::AT_EMPTY_PATH;
+    if recursive {
+        flags |= libc::AT_RECURSIVE;
+    }
+    let mut attr = libc::mount_attr {
+        attr_set: MountAttrFlags::MOUNT_ATTR_IDMAP.bits() as u64,
+        attr_clr: 0,
+        propagation: 0,
+        userns_fd: userns.as_raw_fd() as u64,
+    };
+    raw_mount_setattr(mnt_fd.as_raw_fd(), c"", flags, &mut attr)
+}
+
+fn raw_mount_setattr(
+    dirfd: libc::c_int,
+    path: &CStr,
+    flags: libc::c_int,
+    attr: &mut libc::mount_attr,
+) -> rustix::io::Result<()> {
+    retry_eintr(|| {
+        // SAFETY: path is NUL-terminated and attr is a mount_attr of the size
+        // passed alongside it; both outlive the call.
+        let ret = unsafe {
+            libc::syscall(
+                libc::SYS_mount_setattr,
+                dirfd,
+                path.as_ptr(),
+                flags,
+                attr as *mut libc::mount_attr,
+                std::mem::size_of::<libc::mount_attr>(),
+            )
+        };
+        if ret < 0 {
+            return Err(Errno::from_io_error(&std::io::Error::last_os_error()).unwrap_or(Errno::IO));
+        }
+        Ok(())
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::cell::Cell;
+
+    #[test]
+    fn retry_eintr_retries_only_eintr() {
+        let calls = Cell::new(0);
+        let res = retry_eintr(|| {
+            calls.set(calls.get() + 1);
+            match calls.get() {
+                1 | 2 => Err(Errno::INTR),
+                n => Ok(n),
+            }
+        });
+        assert_eq!(res, Ok(3));
+
+        calls.set(0);
+        let res: rustix::io::Result<()> = retry_eintr(|| {
+            calls.set(calls.get() + 1);
+            Err(Errno::INVAL)
+        });
+        assert_eq!(res, Err(Errno::INVAL));
+        assert_eq!(calls.get(), 1);
+    }
+}
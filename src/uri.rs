@@ -0,0 +1,129 @@
+//! Parsing a whole mount request from a single URI.
+
+use crate::options::FsOption;
+
+/// A mount given as `<fstype>://<target>?<options>`, e.g.
+/// `tmpfs:///mnt/x?size=4M&mode=1777`.
+///
+/// Query parameters are `&`-separated options in `-o` syntax, except for
+/// `source=`, which sets the source. Percent escapes are decoded in the
+/// target and in each parameter after splitting, so `%26` and `%3D` can be
+/// used for a literal `&` or `=` in a value. A `+` is left as is, since
+/// option keys such as overlay's `lowerdir+` contain one.
+#[derive(Clone, Debug)]
+pub struct MountUri {
+    pub fstype: String,
+    pub target: String,
+    pub source: String,
+    pub options: Vec<FsOption>,
+}
+
+impl MountUri {
+    pub fn parse(s: &str) -> Result<MountUri, String> {
+        let Some((fstype, rest)) = s.split_once("://") else {
+            return Err(format!("expected <fstype>://<target> in {:?}", s));
+        };
+        if fstype.is_empty() {
+            return Err(format!("missing fstype in {:?}", s));
+        }
+        let (path, query) = match rest.split_once('?') {
+            Some((path, query)) => (path, Some(query)),
+            None => (rest, None),
+        };
+        // Only the empty authority of tmpfs:///mnt/x is supported
+        if !path.starts_with('/') {
+            return Err(format!("target in {:?} must be an absolute path", s));
+        }
+        let mut uri = MountUri {
+            fstype: fstype.to_string(),
+            target: decode(path)?,
+            source: String::new(),
+            options: Vec::new(),
+        };
+        for param in query.into_iter().flat_map(|q| q.split('&')) {
+            if param.is_empty() {
+                continue;
+            }
+            let param = decode(param)?;
+            match param.strip_prefix("source=") {
+                Some(source) => uri.source = source.to_string(),
+                None => uri.options.push(FsOption::parse(&param)?),
+            }
+        }
+        Ok(uri)
+    }
+}
+
+/// Decodes %XX escapes.
+fn decode(s: &str) -> Result<String, String> {
+    let bytes = s.as_bytes();
+    let mut out = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        if bytes[i] == b'%' {
+            let byte = s
+                .get(i + 1..i + 3)
+                .and_then(|hex| u8::from_str_radix(hex, 16).ok())
+                .ok_or_else(|| format!("invalid percent escape in {:?}", s))?;
+            out.push(byte);
+            i += 3;
+        } else {
+            out.push(bytes[i]);
+            i += 1;
+        }
+    }
+    String::from_utf8(out).map_err(|_| format!("percent escapes in {:?} are not valid UTF-8", s))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn options(uri: &MountUri) -> Vec<String> {
+        uri.options.iter().map(|opt| opt.to_string()).collect()
+    }
+
+    #[test]
+    fn parses_fstype_target_and_options() {
+        let uri = MountUri::parse("tmpfs:///mnt/x?size=4M&mode=1777").unwrap();
+        assert_eq!(uri.fstype, "tmpfs");
+        assert_eq!(uri.target, "/mnt/x");
+        assert_eq!(uri.source, "");
+        assert_eq!(options(&uri), ["size=4M", "mode=1777"]);
+
+        let uri = MountUri::parse("ext4:///data?source=/dev/sdb1&noload&&").unwrap();
+        assert_eq!(uri.source, "/dev/sdb1");
+        assert_eq!(options(&uri), ["noload"]);
+
+        let uri = MountUri::parse("proc:///proc").unwrap();
+        assert!(uri.options.is_empty());
+    }
+
+    #[test]
+    fn decodes_escapes_after_splitting() {
+        let uri = MountUri::parse("overlay:///mnt/with%20space?lowerdir+=/a%26b&upperdir=/u%3Dv")
+            .unwrap();
+        assert_eq!(uri.target, "/mnt/with space");
+        assert_eq!(options(&uri), ["lowerdir+=/a&b", "upperdir=/u=v"]);
+        assert_eq!(uri.options[0].key, "lowerdir+");
+        assert_eq!(
+            MountUri::parse("tmpfs:///mnt?x=%zz").unwrap_err(),
+            "invalid percent escape in \"x=%zz\""
+        );
+        assert!(MountUri::parse("tmpfs:///mnt?x=%ff").is_err());
+        assert!(MountUri::parse("tmpfs:///mnt?x=%4").is_err());
+    }
+
+    #[test]
+    fn rejects_malformed_uris() {
+        assert!(MountUri::parse("/mnt/x").is_err());
+        assert_eq!(
+            MountUri::parse(":///mnt").unwrap_err(),
+            "missing fstype in \":///mnt\""
+        );
+        assert_eq!(
+            MountUri::parse("tmpfs://host/mnt").unwrap_err(),
+            "target in \"tmpfs://host/mnt\" must be an absolute path"
+        );
+    }
+}
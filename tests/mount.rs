@@ -0,0 +1,467 @@
+//! Tests that mount for real. They need root and are skipped unless
+//! RUN_MOUNT_TESTS is set. Each runs in a private mount namespace of its
+//! own, so nothing it mounts shows up on the host or outlives it.
+
+use mic::error::MountError;
+use mic::fs_context::FsContext;
+use mic::log::Log;
+use mic::mount::{self, MountOptions};
+use mic::options::FsOption;
+use nix::sched::{unshare, CloneFlags};
+use rustix::mount::{mount_change, MountAttrFlags, MountPropagationFlags};
+use std::os::unix::fs::MetadataExt;
+use std::os::unix::process::CommandExt;
+use std::path::PathBuf;
+use std::process::{Command, Output};
+
+fn enabled() -> bool {
+    std::env::var_os("RUN_MOUNT_TESTS").is_some()
+}
+
+/// Moves the calling test thread into a new mount namespace whose mounts
+/// do not propagate back.
+fn private_namespace() {
+    unshare(CloneFlags::CLONE_NEWNS).expect("unshare CLONE_NEWNS");
+    mount_change(
+        "/",
+        MountPropagationFlags::REC | MountPropagationFlags::PRIVATE,
+    )
+    .expect("making / private");
+}
+
+/// Returns an empty directory for test name under the temporary directory.
+fn scratch_dir(name: &str) -> PathBuf {
+    let dir = std::env::temp_dir().join(format!("mic-test-{}-{}", name, std::process::id()));
+    let _ = std::fs::remove_dir_all(&dir);
+    std::fs::create_dir_all(&dir).expect("creating scratch dir");
+    dir
+}
+
+/// Runs the mic binary with args, in the calling thread's namespaces.
+fn mic(args: &[&str]) -> Output {
+    Command::new(env!("CARGO_BIN_EXE_mic"))
+        .args(args)
+        .output()
+        .expect("running mic")
+}
+
+#[test]
+fn fs_context_mounts_two_targets() {
+    if !enabled() {
+        return;
+    }
+    private_namespace();
+    let dir = scratch_dir("fs-context");
+    let (a, b) = (dir.join("a"), dir.join("b"));
+    std::fs::create_dir(&a).unwrap();
+    std::fs::create_dir(&b).unwrap();
+
+    let ctx = FsContext::open("tmpfs").unwrap();
+    ctx.create().unwrap();
+    ctx.mount(&a, MountAttrFlags::empty()).unwrap();
+    ctx.mount(&b, MountAttrFlags::empty()).unwrap();
+
+    // Both are mounts of the one superblock
+    std::fs::write(a.join("file"), "shared").unwrap();
+    assert_eq!(std::fs::read_to_string(b.join("file")).unwrap(), "shared");
+}
+
+#[test]
+fn continue_on_option_error_collects_rejections() {
+    if !enabled() {
+        return;
+    }
+    let mut opts = MountOptions {
+        fstype: Some("tmpfs".to_string()),
+        options: ["bogus", "size=1M", "nosuchkey=1"]
+            .iter()
+            .map(|o| FsOption::parse(o).unwrap())
+            .collect(),
+        continue_on_option_error: true,
+        ..MountOptions::default()
+    };
+    let err = mount::configure("tmpfs", &opts, &Log::quiet())
+        .err()
+        .expect("bogus options accepted");
+    let MountError::Rejected { errors, .. } = &err else {
+        panic!("unexpected error: {}", err);
+    };
+    assert_eq!(errors.len(), 2);
+    assert!(err
+        .to_string()
+        .starts_with("2 option(s) rejected by tmpfs: bogus: "));
+
+    opts.ignore_option_errors = true;
+    let (_, applied) = mount::configure("tmpfs", &opts, &Log::quiet()).unwrap();
+    assert_eq!(applied.options, ["size=1M"]);
+    assert_eq!(applied.rejected.len(), 2);
+}
+
+#[test]
+fn also_at_binds_the_same_mount() {
+    if !enabled() {
+        return;
+    }
+    private_namespace();
+    let dir = scratch_dir("also-at");
+    let (a, b) = (dir.join("a"), dir.join("b"));
+    std::fs::create_dir(&a).unwrap();
+    std::fs::create_dir(&b).unwrap();
+
+    let out = mic(&[
+        "--target",
+        a.to_str().unwrap(),
+        "--fstype",
+        "tmpfs",
+        "--also-at",
+        b.to_str().unwrap(),
+    ]);
+    assert!(
+        out.status.success(),
+        "{}",
+        String::from_utf8_lossy(&out.stderr)
+    );
+    std::fs::write(a.join("file"), "shared").unwrap();
+    assert_eq!(std::fs::read_to_string(b.join("file")).unwrap(), "shared");
+
+    // A failing path fails the run, but the others are still bound
+    let c = dir.join("c");
+    std::fs::create_dir(&c).unwrap();
+    let out = mic(&[
+        "--target",
+        a.to_str().unwrap(),
+        "--fstype",
+        "tmpfs",
+        "--warn-overmount",
+        "--also-at",
+        dir.join("missing").to_str().unwrap(),
+        "--also-at",
+        c.to_str().unwrap(),
+    ]);
+    // The missing path fails at move_mount
+    assert_eq!(out.status.code(), Some(14));
+    assert!(
+        String::from_utf8_lossy(&out.stderr).contains("not every --also-at path could be bound")
+    );
+    // c has the new, empty tmpfs now on top of a
+    assert!(!c.join("file").exists());
+    std::fs::write(a.join("new"), "").unwrap();
+    assert!(c.join("new").exists());
+}
+
+#[test]
+fn then_ro_covers_submounts_of_a_recursive_bind() {
+    if !enabled() {
+        return;
+    }
+    private_namespace();
+    let dir = scratch_dir("then-ro");
+    let (src, dst) = (dir.join("src"), dir.join("dst"));
+    std::fs::create_dir_all(src.join("sub")).unwrap();
+    std::fs::create_dir(&dst).unwrap();
+    let sub = src.join("sub");
+    let out = mic(&["--target", sub.to_str().unwrap(), "--fstype", "tmpfs"]);
+    assert!(out.status.success());
+
+    let out = mic(&[
+        "--source",
+        src.to_str().unwrap(),
+        "--target",
+        dst.to_str().unwrap(),
+        "--then-ro",
+    ]);
+    assert!(
+        out.status.success(),
+        "{}",
+        String::from_utf8_lossy(&out.stderr)
+    );
+    for path in [dst.join("file"), dst.join("sub").join("file")] {
+        let err = std::fs::write(&path, "").unwrap_err();
+        assert_eq!(err.raw_os_error(), Some(libc::EROFS), "{}", path.display());
+    }
+    // Only the bind was made read-only, not what it was bound from
+    std::fs::write(sub.join("file"), "").unwrap();
+}
+
+#[test]
+fn multibyte_option_values_reach_the_kernel_unchanged() {
+    if !enabled() {
+        return;
+    }
+    private_namespace();
+    let dir = scratch_dir("multibyte");
+    // A lowerdir whose bytes were changed on the way would not resolve
+    let (a, b) = (dir.join("étiquette-ラベル-€"), dir.join("b-ü"));
+    let target = dir.join("target");
+    for d in [&a, &b, &target] {
+        std::fs::create_dir(d).unwrap();
+    }
+    std::fs::write(a.join("file"), "").unwrap();
+    let lowerdir = format!("lowerdir={}:{}", a.display(), b.display());
+    let opt = FsOption::parse(&lowerdir).unwrap();
+    assert_eq!(opt.to_string().as_bytes(), lowerdir.as_bytes());
+
+    let out = mic(&[
+        "--target",
+        target.to_str().unwrap(),
+        "--fstype",
+        "overlay",
+        "-o",
+        &lowerdir,
+    ]);
+    assert!(
+        out.status.success(),
+        "{}",
+        String::from_utf8_lossy(&out.stderr)
+    );
+    assert!(target.join("file").exists());
+}
+
+#[test]
+fn readonly_mount_is_ro_in_proc_mounts() {
+    if !enabled() {
+        return;
+    }
+    private_namespace();
+    let dir = scratch_dir("readonly");
+    let out = mic(&[
+        "--target",
+        dir.to_str().unwrap(),
+        "--fstype",
+        "tmpfs",
+        "--readonly",
+    ]);
+    assert!(
+        out.status.success(),
+        "{}",
+        String::from_utf8_lossy(&out.stderr)
+    );
+    // Only this thread is in the private namespace, not the whole process
+    let mounts = std::fs::read_to_string("/proc/thread-self/mounts").unwrap();
+    let line = mounts
+        .lines()
+        .rfind(|line| line.split(' ').nth(1) == dir.to_str())
+        .expect("mount missing from /proc/thread-self/mounts");
+    let options: Vec<&str> = line.split(' ').nth(3).unwrap().split(',').collect();
+    assert_eq!(options[0], "ro", "{}", line);
+}
+
+#[test]
+fn userns_idmaps_file_ownership() {
+    if !enabled() {
+        return;
+    }
+    private_namespace();
+    let dir = scratch_dir("idmap");
+    let (src, dst) = (dir.join("src"), dir.join("dst"));
+    std::fs::create_dir(&src).unwrap();
+    std::fs::create_dir(&dst).unwrap();
+    // tmpfs supports idmapped mounts wherever the scratch dir may live
+    let out = mic(&["--target", src.to_str().unwrap(), "--fstype", "tmpfs"]);
+    assert!(out.status.success());
+    std::fs::write(src.join("file"), "").unwrap();
+
+    // A process in a user namespace that maps 0 to 100000
+    let mut holder = Command::new("sleep");
+    holder.arg("30");
+    // SAFETY: unshare is async-signal-safe and touches no memory of the parent
+    unsafe {
+        holder.pre_exec(|| unshare(CloneFlags::CLONE_NEWUSER).map_err(std::io::Error::from));
+    }
+    let mut holder = holder.spawn().unwrap();
+    let proc_dir = PathBuf::from(format!("/proc/{}", holder.id()));
+    std::fs::write(proc_dir.join("uid_map"), "0 100000 65536").unwrap();
+    std::fs::write(proc_dir.join("gid_map"), "0 100000 65536").unwrap();
+
+    let out = mic(&[
+        "--source",
+        src.to_str().unwrap(),
+        "--target",
+        dst.to_str().unwrap(),
+        "--userns",
+        proc_dir.join("ns/user").to_str().unwrap(),
+    ]);
+    let _ = holder.kill();
+    let _ = holder.wait();
+    assert!(
+        out.status.success(),
+        "{}",
+        String::from_utf8_lossy(&out.stderr)
+    );
+    let shifted = std::fs::metadata(dst.join("file")).unwrap();
+    assert_eq!((shifted.uid(), shifted.gid()), (100000, 100000));
+    let original = std::fs::metadata(src.join("file")).unwrap();
+    assert_eq!((original.uid(), original.gid()), (0, 0));
+}
+
+/// Starts a process in a mount namespace of its own, a copy of the calling
+/// thread's, and returns it with the path of that namespace.
+fn namespace_holder() -> (std::process::Child, PathBuf) {
+    let mut holder = Command::new("sleep");
+    holder.arg("30");
+    // SAFETY: unshare is async-signal-safe and touches no memory of the parent
+    unsafe {
+        holder.pre_exec(|| unshare(CloneFlags::CLONE_NEWNS).map_err(std::io::Error::from));
+    }
+    let holder = holder.spawn().expect("starting namespace holder");
+    let ns = PathBuf::from(format!("/proc/{}/ns/mnt", holder.id()));
+    // The namespace is only there once the child has run unshare
+    while std::fs::read_link(&ns).ok() == std::fs::read_link("/proc/thread-self/ns/mnt").ok() {
+        std::thread::yield_now();
+    }
+    (holder, ns)
+}
+
+fn thread_namespace() -> u64 {
+    std::fs::metadata("/proc/thread-self/ns/mnt").unwrap().ino()
+}
+
+#[test]
+fn mount_namespace_is_restored_after_mounting() {
+    if !enabled() {
+        return;
+    }
+    // setns needs a thread that does not share its fs info
+    unshare(CloneFlags::CLONE_FS).expect("unshare CLONE_FS");
+    private_namespace();
+    let dir = scratch_dir("ns-restore");
+    let (mut holder, ns) = namespace_holder();
+    let before = thread_namespace();
+
+    let mut opts = MountOptions {
+        target: dir.clone(),
+        fstype: Some("tmpfs".to_string()),
+        mount_ns: Some(ns),
+        ..MountOptions::default()
+    };
+    mount::mount(&opts).unwrap();
+    assert_eq!(thread_namespace(), before);
+    let theirs = std::fs::read_to_string(format!("/proc/{}/mountinfo", holder.id())).unwrap();
+    let ours = std::fs::read_to_string("/proc/thread-self/mountinfo").unwrap();
+    let target = format!(" {} ", dir.display());
+    assert!(theirs.contains(&target));
+    assert!(!ours.contains(&target));
+
+    // A failed attach returns to the original namespace as well
+    opts.target = dir.join("missing");
+    mount::mount(&opts).unwrap_err();
+    assert_eq!(thread_namespace(), before);
+    let _ = holder.kill();
+    let _ = holder.wait();
+}
+
+#[test]
+fn mount_namespace_gets_the_mount_and_the_caller_does_not() {
+    if !enabled() {
+        return;
+    }
+    private_namespace();
+    let dir = scratch_dir("namespaced");
+    let (mut holder, ns) = namespace_holder();
+    let out = mic(&[
+        "--target",
+        dir.to_str().unwrap(),
+        "--fstype",
+        "tmpfs",
+        "--mount-namespace",
+        ns.to_str().unwrap(),
+    ]);
+    assert!(
+        out.status.success(),
+        "{}",
+        String::from_utf8_lossy(&out.stderr)
+    );
+    // The child's root shows the paths as its namespace resolves them
+    let root = PathBuf::from(format!("/proc/{}/root", holder.id()));
+    let theirs = root.join(dir.strip_prefix("/").unwrap());
+    let ours = std::fs::metadata(&dir).unwrap();
+    let mounted = std::fs::metadata(&theirs).unwrap();
+    let parent = std::fs::metadata(dir.parent().unwrap()).unwrap();
+    assert_ne!(mounted.dev(), parent.dev());
+    assert_eq!(ours.dev(), parent.dev());
+    std::fs::write(theirs.join("file"), "").unwrap();
+    assert!(!dir.join("file").exists());
+    let _ = holder.kill();
+    let _ = holder.wait();
+}
+
+#[test]
+fn kernel_tells_flags_from_empty_strings() {
+    if !enabled() {
+        return;
+    }
+    let set = |spec: &str| {
+        let ctx = FsContext::open("tmpfs").unwrap();
+        ctx.set_option(&FsOption::parse(spec).unwrap())
+    };
+    // noswap is a flag: the same key with an empty string is refused
+    set("noswap").unwrap();
+    assert_eq!(set("noswap="), Err(rustix::io::Errno::INVAL));
+    set("mode=0700").unwrap();
+}
+
+#[test]
+fn namespace_steps_exit_with_their_status() {
+    if !enabled() {
+        return;
+    }
+    private_namespace();
+    let dir = scratch_dir("ns-status");
+    let (target, proc_dir) = (dir.join("target"), dir.join("proc"));
+    std::fs::create_dir(&target).unwrap();
+    std::fs::create_dir(&proc_dir).unwrap();
+    // A procfs without the original namespace to return to
+    let out = mic(&[
+        "--target",
+        target.to_str().unwrap(),
+        "--fstype",
+        "tmpfs",
+        "--proc-path",
+        proc_dir.to_str().unwrap(),
+        "--skip-cap-check",
+    ]);
+    assert_eq!(out.status.code(), Some(15));
+    assert!(String::from_utf8_lossy(&out.stderr).starts_with("open original mount namespace "));
+    let out = mic(&[
+        "--target",
+        target.to_str().unwrap(),
+        "--fstype",
+        "tmpfs",
+        "--mount-namespace",
+        proc_dir.join("missing").to_str().unwrap(),
+    ]);
+    assert_eq!(out.status.code(), Some(15));
+}
+
+#[test]
+fn report_namespace_under_timeout_names_the_target_namespace() {
+    if !enabled() {
+        return;
+    }
+    private_namespace();
+    let dir = scratch_dir("ns-report-timeout");
+    let (mut holder, ns) = namespace_holder();
+    // --timeout mounts from a worker thread, which alone enters ns
+    let out = mic(&[
+        "--target",
+        dir.to_str().unwrap(),
+        "--fstype",
+        "tmpfs",
+        "--mount-namespace",
+        ns.to_str().unwrap(),
+        "--report-namespace",
+        "--timeout",
+        "5s",
+    ]);
+    assert!(
+        out.status.success(),
+        "{}",
+        String::from_utf8_lossy(&out.stderr)
+    );
+    let theirs = std::fs::metadata(&ns).unwrap().ino();
+    let stdout = String::from_utf8_lossy(&out.stdout);
+    assert!(stdout.contains(&format!("mnt:[{}]", theirs)), "{}", stdout);
+    assert!(!stdout.contains(&format!("mnt:[{}]", thread_namespace())));
+    let _ = holder.kill();
+    let _ = holder.wait();
+}